@@ -0,0 +1,94 @@
+package maatq
+
+import (
+	"errors"
+	"time"
+)
+
+// 存储后端，Worker、Broker 和 Scheduler 通过它读写队列和状态
+// 默认使用 Redis，单元测试中可以使用内存实现
+
+var (
+	// ErrNil 键不存在或者等待队列超时
+	ErrNil = errors.New("maatq: nil")
+)
+
+// Backend 存储后端，语义和 Redis 相应的命令一致
+type Backend interface {
+	Ping() error
+	Close() error
+
+	// 队列
+	Push(queue string, data []byte) error
+	PushFront(queue string, data []byte) error
+	// Pop 按顺序从第一个非空的队列头部取出消息，等待 timeout 后仍没有消息时返回 ErrNil
+	Pop(timeout time.Duration, queues ...string) (string, []byte, error)
+	Len(queue string) (int64, error)
+	Range(queue string, start, stop int64) ([][]byte, error)
+
+	// 键值，ttl 为0时不过期
+	Get(key string) ([]byte, error)
+	MGet(keys ...string) ([][]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Del(keys ...string) error
+
+	// 集合
+	SAdd(key string, members ...string) error
+	SRem(key string, members ...string) error
+	SMembers(key string) ([]string, error)
+
+	// 有序集合
+	ZAdd(key string, score float64, member string) error
+	ZRem(key string, members ...string) error
+	ZRangeByScore(key string, min, max float64) ([]string, error)
+	ZRemRangeByScore(key string, min, max float64) error
+
+	// 租约，键不存在或者持有者是 owner 时设置持有者并延长 ttl，返回是否持有租约
+	Lease(key, owner string, ttl time.Duration) (bool, error)
+	// Release 持有者是 owner 时释放租约
+	Release(key, owner string) error
+}
+
+// 把 LRANGE 风格的下标转换成切片的范围，负数表示从尾部开始，范围为空时返回 false
+func clampRange(n, start, stop int64) (int64, int64, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return start, stop + 1, start <= stop
+}
+
+// QueueEntry 写入队列的一条消息
+type QueueEntry struct {
+	Queue string
+	Data  []byte
+}
+
+// BatchPusher 可以一次写入多条消息的存储后端，Redis 使用事务，要么全部写入要么全部失败
+type BatchPusher interface {
+	PushBatch(entries []QueueEntry) error
+}
+
+// 一次写入多条消息，存储后端不支持时逐条写入，返回写入成功的数量
+func pushBatch(backend Backend, entries []QueueEntry) (int, error) {
+	if p, ok := backend.(BatchPusher); ok {
+		if err := p.PushBatch(entries); err != nil {
+			return 0, err
+		}
+		return len(entries), nil
+	}
+	for i, e := range entries {
+		if err := backend.Push(e.Queue, e.Data); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
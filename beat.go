@@ -1,20 +1,17 @@
 package maatq
 
 import (
-	"bytes"
-	"container/heap"
 	"encoding/gob"
-	"encoding/json"
 	"errors"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/go-redis/redis"
 )
 
 // The periodic task Scheduler
 
+// 用于读取旧版本 gob 编码的快照
 func init() {
 	gob.Register(&minHeap{})
 	gob.Register(&PriorityMessage{})
@@ -28,6 +25,11 @@ const (
 	MAATQ_DUMPS_KEY                    = "maatq:heap:dumps"
 )
 
+var (
+	ErrEmptyFilter      = errors.New("schedule filter is empty")
+	ErrScheduleNotFound = errors.New("schedule not found")
+)
+
 type Scheduler struct {
 	mu           sync.Mutex
 	interval     time.Duration
@@ -35,13 +37,90 @@ type Scheduler struct {
 	logger       *log.Entry
 	lastSyncTime time.Time
 	isRunning    bool
-	r            *redis.Client
+	backend      Backend
 	csleep       *cancelSleep
 	health       *checkItem
+
+	// 选举，见 EnableLeaderElection
+	ha        bool
+	leader    bool
+	leaseTTL  time.Duration
+	owner     string
+	renewedAt time.Time
+	onElected func()
+	// 任务有变化，还没有保存到共享存储
+	dirty bool
+	// 设置后任务保存在存储中，不使用内存中的堆
+	store ScheduleStore
+	// 预写日志和保存快照的间隔，见 SetJournal
+	journal          Journal
+	snapshotInterval time.Duration
+	// 执行任务的统计
+	metrics dispatchMetrics
+	// 回收被取消的任务的数据，见 SetReleaseFunc
+	release func(m *Message)
+	// 正在写入工作队列的任务，写入期间仍然可以按编号查找、取消和修改，见 dispatchDue
+	inflight map[string]*PriorityMessage
+	// 保证日志的顺序，整批执行的日志在 s.mu 之外写入，见 appendJournal
+	journalMu sync.Mutex
+}
+
+// SetStore 使用持久化的存储保存任务，见 ScheduleStore
+func (s *Scheduler) SetStore(store ScheduleStore) {
+	s.store = store
 }
 
 func (s *Scheduler) toJSON() string {
-	return s.heap.String()
+	items, err := s.items()
+	if err != nil {
+		return err.Error()
+	}
+	return minHeap{Items: &items}.String()
+}
+
+// 列出所有任务，非 leader 返回共享存储中的任务，返回的是任务的副本
+func (s *Scheduler) items() ([]*PriorityMessage, error) {
+	if s.store != nil {
+		return s.store.List()
+	}
+	if !s.IsLeader() {
+		h, err := s.loads()
+		if err == ErrNil {
+			return []*PriorityMessage{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return *h.Items, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := s.all()
+	rv := make([]*PriorityMessage, len(all))
+	for i, pm := range all {
+		v := *pm
+		rv[i] = &v
+	}
+	return rv, nil
+}
+
+// 堆中和正在写入工作队列的所有任务，调用时需要持有 s.mu
+func (s *Scheduler) all() []*PriorityMessage {
+	rv := make([]*PriorityMessage, 0, s.heap.Len()+len(s.inflight))
+	rv = append(rv, *s.heap.Items...)
+	for _, pm := range s.inflight {
+		rv = append(rv, pm)
+	}
+	return rv
+}
+
+// 按编号查找任务，包括正在写入工作队列的任务，调用时需要持有 s.mu
+func (s *Scheduler) lookup(id string) (pm *PriorityMessage, dispatching bool, ok bool) {
+	if pm, ok := s.heap.get(id); ok {
+		return pm, false, true
+	}
+	pm, ok = s.inflight[id]
+	return pm, ok, ok
 }
 
 func (s *Scheduler) SetInterval(v time.Duration) {
@@ -53,6 +132,16 @@ func (s *Scheduler) ServeLoop() {
 	s.logger.Debugf("Ticking with max interval %s", s.interval.String())
 
 	for s.isRunning {
+		if s.ha {
+			s.elect()
+			if !s.IsLeader() {
+				s.health.Alive()
+				s.csleep.Sleep(s.leaseTTL / 3)
+				continue
+			}
+			s.receiveCommands()
+		}
+
 		d, err := s.tick()
 
 		if err != nil {
@@ -60,6 +149,15 @@ func (s *Scheduler) ServeLoop() {
 			s.dumps()
 		}
 
+		s.snapshot()
+		if s.ha {
+			s.sync()
+			// 及时续约
+			if d > s.leaseTTL/3 {
+				d = s.leaseTTL / 3
+			}
+		}
+
 		if int64(d) > 0 {
 			s.logger.Debugf("Waking up in %s", d.String())
 			s.csleep.Sleep(d)
@@ -69,96 +167,224 @@ func (s *Scheduler) ServeLoop() {
 	}
 }
 
-// Delay a message in give duration
-func (s *Scheduler) Delay(m *Message, d time.Duration) {
-	t := time.Now().Add(d)
-	pm := &PriorityMessage{*m, t.Unix(), nil}
+// 添加任务，开启选举并且不是 leader 时转交给 leader
+func (s *Scheduler) schedule(pm *PriorityMessage) {
+	if s.store != nil {
+		s.addToStore(pm)
+		return
+	}
 	s.mu.Lock()
-	heap.Push(s.heap, pm)
+	if s.ha && !s.leader {
+		s.mu.Unlock()
+		e, err := newScheduleEntry(pm)
+		if err == nil {
+			err = s.send(&JournalEntry{Op: JournalAdd, Entry: e})
+		}
+		if err != nil {
+			s.logger.WithFields(pm.ToLogFields()).WithError(err).Error("Send message to leader error")
+		}
+		return
+	}
+	s.push(pm)
 	s.mu.Unlock()
 	s.csleep.Cancel()
 }
 
+// 把任务写入预写日志并加入堆中，编号相同的任务被替换，调用时需要持有 s.mu
+func (s *Scheduler) push(pm *PriorityMessage) {
+	if s.journal != nil {
+		if e, err := newScheduleEntry(pm); err == nil {
+			s.appendJournal(&JournalEntry{Op: JournalAdd, Entry: e})
+		}
+	}
+	s.heap.upsert(pm)
+	// 正在写入工作队列的旧任务写入后不再放回堆中
+	delete(s.inflight, pm.Id)
+	s.dirty = true
+}
+
+// Delay a message in give duration
+func (s *Scheduler) Delay(m *Message, d time.Duration) {
+	t := time.Now().Add(d)
+	s.schedule(&PriorityMessage{Message: *m, T: t.Unix()})
+}
+
 // 添加周期执行的任务
 func (s *Scheduler) Period(m *Message, p *Period) {
 	s.logger.WithFields(m.ToLogFields()).WithField("period", time.Second*time.Duration(p.Cycle)).Info("Periodic message recieved")
 	t := p.Next()
-	pm := &PriorityMessage{*m, t.Unix(), p}
-	s.mu.Lock()
-	heap.Push(s.heap, pm)
-	s.mu.Unlock()
-	s.csleep.Cancel()
+	s.schedule(&PriorityMessage{Message: *m, T: t.Unix(), P: p})
 }
 
 // 添加Crontab任务
 func (s *Scheduler) Crontab(m *Message, cron *Crontab) {
 	s.logger.WithFields(m.ToLogFields()).WithField("crontab", cron.Text).Info("Crontab message recieved")
 	t := cron.Next()
-	pm := &PriorityMessage{*m, t.Unix(), cron}
-	s.mu.Lock()
-	heap.Push(s.heap, pm)
-	s.mu.Unlock()
-	s.csleep.Cancel()
+	s.schedule(&PriorityMessage{Message: *m, T: t.Unix(), P: cron})
 }
 
-// 取消一个任务
+// 取消一个任务，开启选举并且不是 leader 时在共享存储中查找任务并转交给 leader
 func (s *Scheduler) Cancel(id string) bool {
+	pm, ok := s.cancel(id)
+	if ok && pm != nil {
+		s.releaseMessage(&pm.Message)
+	}
+	return ok
+}
+
+// 取消任务并返回被取消的任务，不回收数据。转交给 leader 时返回 nil，由 leader 回收
+func (s *Scheduler) cancel(id string) (*PriorityMessage, bool) {
+	if s.store != nil {
+		pm, err := s.store.Get(id)
+		if err != nil && err != ErrNil {
+			s.logger.WithError(err).Error("Get message from store error")
+		}
+		ok, err := s.store.Remove(id)
+		if err != nil {
+			s.logger.WithError(err).Error("Remove message from store error")
+		}
+		return pm, ok
+	}
+	if !s.IsLeader() {
+		h, err := s.loads()
+		if err != nil || h.find(id) < 0 {
+			return nil, false
+		}
+		if err := s.send(&JournalEntry{Op: JournalCancel, Id: id}); err != nil {
+			s.logger.WithError(err).Error("Send cancel to leader error")
+			return nil, false
+		}
+		return nil, true
+	}
+
 	s.csleep.Cancel()
-	items := *s.heap.Items
-	for i := 0; i < s.heap.Len(); i++ {
-		item := items[i]
-		if item.Id == id {
-			s.mu.Lock()
-			m1 := heap.Remove(s.heap, i)
-			s.mu.Unlock()
-			m2 := m1.(*PriorityMessage)
-			log.WithFields(m2.ToLogFields()).Warn("Canceld")
-			return true
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.heap.remove(id)
+	if !ok {
+		// 正在写入工作队列的任务写入后不再放回堆中
+		if m, ok = s.inflight[id]; !ok {
+			return nil, false
 		}
+		delete(s.inflight, id)
 	}
-	return false
+	s.appendJournal(&JournalEntry{Op: JournalCancel, Id: id})
+	s.dirty = true
+	log.WithFields(m.ToLogFields()).Warn("Canceld")
+	return m, true
 }
 
-// Run a tick, one iteration of the scheduler, executes one due task per call.
-// Returns preferred delay duration for next call
-func (s *Scheduler) tick() (time.Duration, error) {
-	if s.heap.Len() <= 0 {
-		return s.interval, nil
+// SetReleaseFunc 设置回收任务数据的函数，任务被取消时调用，例如删除转存的消息体
+func (s *Scheduler) SetReleaseFunc(f func(m *Message)) {
+	s.release = f
+}
+
+func (s *Scheduler) releaseMessage(m *Message) {
+	if s.release != nil && len(m.DataRef) > 0 {
+		s.release(m)
 	}
+}
 
+// Get 按编号查找任务，返回任务的副本
+func (s *Scheduler) Get(id string) (*PriorityMessage, bool) {
+	if s.store != nil {
+		pm, err := s.store.Get(id)
+		if err != nil && err != ErrNil {
+			s.logger.WithError(err).Error("Get message from store error")
+		}
+		return pm, err == nil
+	}
+	if !s.IsLeader() {
+		h, err := s.loads()
+		if err != nil {
+			return nil, false
+		}
+		return h.get(id)
+	}
 	s.mu.Lock()
-	m, ok := heap.Pop(s.heap).(*PriorityMessage)
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+	pm, _, ok := s.lookup(id)
 	if !ok {
-		return time.Duration(0), errors.New("Message asserts as *PriorityMessage error.")
+		return nil, false
 	}
-	s.logger.WithFields(m.ToLogFields()).Debug("priority message recieved.")
+	v := *pm
+	return &v, true
+}
 
-	if m.IsDue() {
-		b, err := json.Marshal(m.Message)
-		if err != nil {
-			s.logger.Error(err)
-			return time.Duration(0), err
-		}
-		s.logger.WithField("msg", string(b)).Debugf("Priority message push to queue %s", m.GetWorkQueue())
-		s.r.RPush(m.GetWorkQueue(), string(b))
-		if m.IsPeriodic() {
-			m.T = m.P.Next().Unix()
-			s.mu.Lock()
-			heap.Push(s.heap, m)
-			s.mu.Unlock()
-		}
-		return time.Duration(0), nil
-	} else {
-		d := time.Unix(m.T, 0).Sub(time.Now())
-		if d > s.interval {
-			d = s.interval
-		}
-		s.mu.Lock()
-		heap.Push(s.heap, m)
-		s.mu.Unlock()
-		return d, nil
+// ScheduleFilter 按事件、队列或者标签筛选任务，所有不为空的条件都满足时匹配
+type ScheduleFilter struct {
+	Event string
+	Queue string
+	Tag   string
+}
+
+func (f *ScheduleFilter) empty() bool {
+	return len(f.Event) == 0 && len(f.Queue) == 0 && len(f.Tag) == 0
+}
+
+func (f *ScheduleFilter) match(pm *PriorityMessage) bool {
+	if len(f.Event) > 0 && pm.Event != f.Event {
+		return false
+	}
+	if len(f.Queue) > 0 && tenantQueueName(pm.Tenant, f.Queue) != pm.GetWorkQueue() {
+		return false
+	}
+	if len(f.Tag) > 0 {
+		for _, tag := range pm.Tags {
+			if tag == f.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// CancelMatching 取消所有匹配的任务，返回取消的数量，条件都为空时不取消任何任务
+func (s *Scheduler) CancelMatching(f *ScheduleFilter) (int, error) {
+	if f.empty() {
+		return 0, ErrEmptyFilter
 	}
+	items, err := s.items()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, pm := range items {
+		if f.match(pm) && s.Cancel(pm.Id) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Run a tick, one iteration of the scheduler, executes all due tasks per call.
+// Returns preferred delay duration for next call
+func (s *Scheduler) tick() (time.Duration, error) {
+	if s.store != nil {
+		return s.tickStore()
+	}
+	n, err := s.dispatchDue(time.Now())
+	if err != nil {
+		return dispatchRetryInterval, err
+	}
+	if n > 0 {
+		s.logger.Debugf("%d messages dispatched", n)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.heap.Len() <= 0 || (*s.heap.Items)[0].Paused {
+		return s.interval, nil
+	}
+	d := time.Unix((*s.heap.Items)[0].T, 0).Sub(time.Now())
+	if d > s.interval {
+		d = s.interval
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d, nil
 }
 
 // Mark scheduler as not running
@@ -166,32 +392,96 @@ func (s *Scheduler) shutdown() {
 	s.isRunning = false
 }
 
+// 非 leader 的任务不是最新的，不保存，避免覆盖 leader 保存的任务
+// 使用存储时任务已经持久化，不需要保存
 func (s *Scheduler) dumps() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(s.heap); err != nil {
+	if s.store != nil || (s.ha && !s.leader) {
+		return nil
+	}
+	// 等待正在追加的日志，避免清空日志后才写入
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+	items := s.all()
+	b, err := encodeHeap(&minHeap{Items: &items})
+	if err != nil {
+		return err
+	}
+	if err := s.backend.Set(MAATQ_DUMPS_KEY, b, 0); err != nil {
 		return err
 	}
-	return s.r.Set(MAATQ_DUMPS_KEY, buf.Bytes(), 0).Err()
+	// 快照已经包含日志中的变化
+	if s.journal != nil {
+		if err := s.journal.Truncate(); err != nil {
+			return err
+		}
+	}
+	s.dirty = false
+	s.lastSyncTime = time.Now()
+	return nil
 }
 
+// 读取快照，开启预写日志时再重放快照之后的日志
 func (s *Scheduler) loads() (*minHeap, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	var heap minHeap
-	b, err := s.r.Get(MAATQ_DUMPS_KEY).Bytes()
+	h, err := s.loadSnapshot()
+	if s.journal == nil || (err != nil && err != ErrNil) {
+		return h, err
+	}
+	if h == nil {
+		h = newHeap()
+	}
+	n := 0
+	replayErr := s.journal.Replay(func(e *JournalEntry) {
+		if err := e.apply(h); err != nil {
+			s.logger.WithError(err).Errorf("Replay journal %s error", e.Op)
+		}
+		n++
+	})
+	if replayErr != nil {
+		return nil, replayErr
+	}
+	if err == ErrNil && n == 0 {
+		return nil, ErrNil
+	}
+	return h, nil
+}
+
+// 读取快照，旧版本 gob 编码的快照重新保存为 JSON，调用时需要持有 s.mu
+func (s *Scheduler) loadSnapshot() (*minHeap, error) {
+	b, err := s.backend.Get(MAATQ_DUMPS_KEY)
 	if err != nil {
 		return nil, err
 	}
-	buf := bytes.NewBuffer(b)
-	if err := gob.NewDecoder(buf).Decode(&heap); err != nil {
+	h, legacy, err := decodeHeap(b)
+	if err != nil {
 		return nil, err
 	}
-	return &heap, nil
+	if legacy && !(s.ha && !s.leader) {
+		if b, err := encodeHeap(h); err != nil {
+			s.logger.WithError(err).Error("Migrate gob dumps error")
+		} else if err := s.backend.Set(MAATQ_DUMPS_KEY, b, 0); err != nil {
+			s.logger.WithError(err).Error("Migrate gob dumps error")
+		} else {
+			s.logger.Infof("%d messages migrated from gob dumps", h.Len())
+		}
+	}
+	return h, nil
 }
 
 func NewDefaultScheduler(addr, password string) *Scheduler {
+	return NewScheduler(NewRedisBackend(addr, password))
+}
+
+// NewRedisScheduler 使用完整的 Redis 连接配置创建调度器，支持 Sentinel 和 Cluster
+func NewRedisScheduler(opt *RedisOptions) *Scheduler {
+	return NewScheduler(NewRedisBackendWithOptions(opt))
+}
+
+// NewScheduler 使用指定的存储后端创建调度器
+func NewScheduler(backend Backend) *Scheduler {
 	h := newHeap()
 	l := log.WithFields(log.Fields{
 		"workerId": "scheduler",
@@ -201,12 +491,9 @@ func NewDefaultScheduler(addr, password string) *Scheduler {
 		heap:      h,
 		logger:    l,
 		isRunning: true,
-		r: redis.NewClient(&redis.Options{
-			Addr:     addr,
-			Password: password,
-			DB:       0,
-		}),
-		csleep: newCancelSleep(),
-		health: NewCheckItem("Schedular", DEFAULT_MAX_INTERVAL+time.Second, "Task schedular"),
+		backend:   backend,
+		csleep:    newCancelSleep(),
+		inflight:  make(map[string]*PriorityMessage),
+		health:    NewCheckItem("Schedular", DEFAULT_MAX_INTERVAL+time.Second, "Task schedular"),
 	}
 }
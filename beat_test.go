@@ -1,5 +1,10 @@
 package maatq
 
+import (
+	"testing"
+	"time"
+)
+
 // This example demostrate how to use a scheduler
 // func Example_ServeLoop() {
 // 	s := maatq.NewDefaultScheduler("127.0.0.1:6379", "")
@@ -48,3 +53,43 @@ package maatq
 // 		}
 // 	}
 // }
+
+func TestSchedulerGet(t *testing.T) {
+	s := NewScheduler(NewMemoryBackend())
+	s.Delay(&Message{Id: "ID(1)", Event: "hello"}, time.Hour)
+	s.Delay(&Message{Id: "ID(1)", Event: "world"}, time.Hour)
+
+	pm, ok := s.Get("ID(1)")
+	if !ok || pm.Event != "world" || s.heap.Len() != 1 {
+		t.Error("编号相同的任务应该被替换: ", pm)
+	}
+	// 返回的是副本
+	pm.T = 0
+	if v, _ := s.Get("ID(1)"); v.T == 0 {
+		t.Error("修改返回的任务不应该影响调度器")
+	}
+	if _, ok := s.Get("ID(2)"); ok {
+		t.Error("不存在的任务应该返回 false")
+	}
+}
+
+func TestSchedulerCancelMatching(t *testing.T) {
+	s := NewScheduler(NewMemoryBackend())
+	s.Delay(&Message{Id: "ID(1)", Event: "hello", Tags: []string{"billing"}}, time.Hour)
+	s.Delay(&Message{Id: "ID(2)", Event: "hello", Queue: "sms"}, time.Hour)
+	s.Delay(&Message{Id: "ID(3)", Event: "world", Tags: []string{"billing"}}, time.Hour)
+	s.Delay(&Message{Id: "ID(4)", Event: "world"}, time.Hour)
+
+	if _, err := s.CancelMatching(&ScheduleFilter{}); err != ErrEmptyFilter {
+		t.Error("条件为空时应该返回错误: ", err)
+	}
+	if n, _ := s.CancelMatching(&ScheduleFilter{Event: "hello", Tag: "billing"}); n != 1 {
+		t.Error("按事件和标签取消任务错误: ", n)
+	}
+	if n, _ := s.CancelMatching(&ScheduleFilter{Queue: "sms"}); n != 1 {
+		t.Error("按队列取消任务错误: ", n)
+	}
+	if n, _ := s.CancelMatching(&ScheduleFilter{Queue: "default"}); n != 2 || s.heap.Len() != 0 {
+		t.Error("按默认队列取消任务错误: ", n, s.heap.Len())
+	}
+}
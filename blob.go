@@ -0,0 +1,103 @@
+package maatq
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// 大消息体的存储，消息中只保留引用
+
+var (
+	ErrBlobNotFound = errors.New("blob not found")
+)
+
+// BlobStore 保存被移出消息的数据
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// FileBlobStore 把数据保存在本地文件系统，适合所有代理共享同一个目录的部署
+type FileBlobStore struct {
+	Dir string
+}
+
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{Dir: dir}, nil
+}
+
+// 整个键转义后作为文件名，不同的键不会使用同一个文件
+func (s *FileBlobStore) path(key string) string {
+	return filepath.Join(s.Dir, url.QueryEscape(key))
+}
+
+// 旧版本的文件名，只保留键的最后一段，用于读取和删除升级前保存的数据
+func (s *FileBlobStore) legacyPath(key string) string {
+	return filepath.Join(s.Dir, strings.Replace(filepath.Base(key), ":", "_", -1))
+}
+
+func (s *FileBlobStore) Put(key string, data []byte) error {
+	tmp := s.path(key) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(key))
+}
+
+func (s *FileBlobStore) Get(key string) ([]byte, error) {
+	b, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		b, err = ioutil.ReadFile(s.legacyPath(key))
+	}
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return b, err
+}
+
+func (s *FileBlobStore) Delete(key string) error {
+	for _, path := range []string{s.path(key), s.legacyPath(key)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RedisBlobStore 把数据保存在单独的 Redis 键中
+type RedisBlobStore struct {
+	client redis.UniversalClient
+	ttl    time.Duration
+}
+
+// NewRedisBlobStore ttl 为0时数据不会过期
+func NewRedisBlobStore(client redis.UniversalClient, ttl time.Duration) *RedisBlobStore {
+	return &RedisBlobStore{client: client, ttl: ttl}
+}
+
+func (s *RedisBlobStore) Put(key string, data []byte) error {
+	return s.client.Set(key, data, s.ttl).Err()
+}
+
+func (s *RedisBlobStore) Get(key string) ([]byte, error) {
+	b, err := s.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrBlobNotFound
+	}
+	return b, err
+}
+
+func (s *RedisBlobStore) Delete(key string) error {
+	return s.client.Del(key).Err()
+}
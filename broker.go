@@ -2,76 +2,205 @@ package maatq
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/go-redis/redis"
 	"github.com/google/uuid"
 )
 
+var (
+	ErrSchedulerDisabled = errors.New("scheduler disabled")
+)
+
 // 用于代理启动Workers和Scheduler，并且提供对外HTTP API
 type Broker struct {
 	scheduler *Scheduler
 	group     *WorkerGroup
 	config    *BrokerOptions
 	inspector *healthChecker
-	redis     *redis.Client
+	backend   Backend
+	payload   *payloadPipeline
+	// 调度文件的对账不能并发执行
+	reconcileMu sync.Mutex
+
+	// 存储后端的健康检查项，超时后进入降级模式
+	backendHealth *checkItem
 }
 
 type BrokerOptions struct {
 	Parallel            int
 	Addr                string
 	Password            string
+	Redis               *RedisOptions  // Redis 连接配置，为空时使用 Addr 和 Password
+	Backend             Backend        // 存储后端，为空时使用 Redis 连接配置
+	Streams             *StreamOptions // 使用 Redis Streams 的队列，Backend 为空时有效
+	Namespace           string         // 所有键的命名空间，用于多个环境共享一个 Redis
+	Tenants             []string       // 同时消费这些租户的队列
 	Try                 int
 	Queues              []string
 	Scheduler           bool
 	HealthCheckInterval time.Duration
 	AlertReceiver       string
+	Unhandled           UnhandledPolicy
+	HeartbeatInterval   time.Duration
+	WorkerTTL           time.Duration
+	// 消息数据超过 OffloadThreshold 字节时保存到 BlobStore，为0时不转存
+	BlobStore        BlobStore
+	OffloadThreshold int
+	// 消息数据超过 CompressThreshold 字节时使用 Compression 压缩，可选 gzip, zstd 和 snappy
+	Compression       string
+	CompressThreshold int
+	// 设置后使用主密钥加密消息数据，Worker 使用其中的所有密钥解密
+	Keyring *Keyring
+	// 设置后对写入的消息签名
+	Signer *Signer
+	// 设置后 Worker 验证消息签名，未签名或者签名错误的消息被移入隔离队列
+	Verifier *Verifier
+	// 消息在队列中的序列化格式，可选 application/json, application/msgpack
+	// 和 application/protobuf，为空时使用 JSON
+	ContentType string
+	// 设置后写入消息前使用事件的 JSON Schema 校验数据
+	Schemas *SchemaRegistry
+	// 为 true 时 Worker 在调用处理函数前再次校验数据
+	ValidateOnConsume bool
+	// 事件数据的版本迁移，写入的消息标记为事件的当前版本
+	Upcasters *UpcasterRegistry
+	// 启动时连接存储后端的重试次数，为0时使用 DefaultConnectRetries，小于0时不重试
+	ConnectRetries int
+	// 为 true 时多个代理的调度器通过租约选举，只有 leader 执行任务
+	// SchedulerLeaseTTL 为租约的有效期，为0时使用 DefaultSchedulerLeaseTTL
+	SchedulerHA       bool
+	SchedulerLeaseTTL time.Duration
+	// 为 true 时定时任务保存在存储后端的有序集合中，而不是内存中的堆
+	// 启动时已有的 dumps 会被导入，同时开启 SchedulerHA 时存储后端必须是 Redis
+	DurableSchedules bool
+	// 为 true 时调度器的每次变化写入存储后端中的预写日志，每隔 SnapshotInterval 保存快照，
+	// SchedulerJournalFile 不为空时日志写入本地文件，文件日志不能在多个调度器之间共享
+	SchedulerJournal     bool
+	SchedulerJournalFile string
+	SnapshotInterval     time.Duration
+	// 声明式的调度文件，YAML 或者 TOML 格式，启动时、文件变化时和收到 SIGHUP 时
+	// 和调度器对账，见 ScheduleSpec
+	ScheduleFile string
 }
 
 func NewBroker(config *BrokerOptions) (*Broker, error) {
 	inspector := NewHealthChecker(config.HealthCheckInterval)
+	if config.Redis == nil {
+		config.Redis = &RedisOptions{Addrs: []string{config.Addr}, Password: config.Password}
+	}
+	if config.Unhandled.Action == UnhandledRequeue && !config.Scheduler {
+		return nil, ErrRequeueWithoutScheduler
+	}
+	// 不修改调用者的配置，同一个配置可以创建多个代理
+	backend := openBackend(config.Backend, config.Redis, config.Namespace, config.Streams)
 	group, err := NewWorkerGroup(&GroupOptions{
-		Parallel: config.Parallel,
-		Addr:     config.Addr,
-		Password: config.Password,
-		Try:      config.Try,
-		Queues:   config.Queues,
+		Backend:           backend,
+		Parallel:          config.Parallel,
+		Addr:              config.Addr,
+		Password:          config.Password,
+		Try:               config.Try,
+		Queues:            config.Queues,
+		Tenants:           config.Tenants,
+		Unhandled:         config.Unhandled,
+		HeartbeatInterval: config.HeartbeatInterval,
+		WorkerTTL:         config.WorkerTTL,
+		BlobStore:         config.BlobStore,
+		Keyring:           config.Keyring,
+		Verifier:          config.Verifier,
+		Upcasters:         config.Upcasters,
+		ConnectRetries:    config.ConnectRetries,
 	})
 	if err != nil {
 		return nil, err
 	}
+	if config.ValidateOnConsume {
+		group.SetSchemas(config.Schemas)
+	}
 	broker := &Broker{
 		group:     group,
 		config:    config,
 		inspector: inspector,
-		redis: redis.NewClient(&redis.Options{
-			Addr:     config.Addr,
-			Password: config.Password,
-			DB:       0,
-		}),
+		backend:   backend,
+		payload:   newPayloadPipeline(config.BlobStore, config.OffloadThreshold),
+	}
+	if len(config.Namespace) > 0 {
+		broker.payload.namespace = config.Namespace + ":"
+	}
+	broker.backendHealth = NewCheckItem(backendHealthItem, 3*inspector.interval, "Queue backend connection")
+	broker.inspector.AddItem(broker.backendHealth)
+	if len(config.AlertReceiver) > 0 {
+		broker.backendHealth.SetDeadFunc(NewEmailAlerter(config.AlertReceiver))
+	}
+	if len(config.Compression) > 0 {
+		c, err := GetCompressor(config.Compression)
+		if err != nil {
+			return nil, err
+		}
+		broker.payload.setCompressor(c, config.CompressThreshold)
+	}
+	if config.Keyring != nil {
+		broker.payload.setKeyring(config.Keyring)
+	}
+	if _, err := GetCodec(config.ContentType); err != nil {
+		return nil, err
 	}
 	if config.Scheduler {
-		broker.scheduler = NewDefaultScheduler(config.Addr, config.Password)
+		broker.scheduler = NewScheduler(backend)
+		if config.SchedulerHA {
+			broker.scheduler.EnableLeaderElection(config.SchedulerLeaseTTL)
+		}
+		if config.DurableSchedules {
+			store := NewScheduleStore(backend)
+			if config.SchedulerHA && !isAtomicScheduleStore(store) {
+				return nil, ErrScheduleStoreNotAtomic
+			}
+			broker.scheduler.SetStore(store)
+		}
+		if len(config.SchedulerJournalFile) > 0 {
+			j, err := NewFileJournal(config.SchedulerJournalFile)
+			if err != nil {
+				return nil, err
+			}
+			broker.scheduler.SetJournal(j, config.SnapshotInterval)
+		} else if config.SchedulerJournal {
+			broker.scheduler.SetJournal(NewBackendJournal(backend), config.SnapshotInterval)
+		}
 		if len(broker.config.AlertReceiver) > 0 {
 			log.Infof("报警邮件接受人设置为: %s", broker.config.AlertReceiver)
 			broker.scheduler.health.SetDeadFunc(NewEmailAlerter(broker.config.AlertReceiver))
 		}
 		broker.inspector.AddItem(broker.scheduler.health)
+		broker.group.SetDelayFunc(broker.scheduler.Delay)
+		broker.scheduler.SetReleaseFunc(broker.releaseSchedule)
 		h, err := broker.scheduler.loads()
 		log.Debug("Loading dumps: ", h)
 		if err == nil && h != nil && h.Len() > 0 {
 			log.Debug("Dumps loaded")
-			broker.scheduler.heap = h
+			if err := broker.scheduler.restore(h); err != nil {
+				return nil, err
+			}
 		}
 		if err != nil {
 			log.Error("Dumps load error: ", err)
 		}
+		if len(config.ScheduleFile) > 0 {
+			if _, err := broker.ReloadSchedules(); err != nil {
+				return nil, err
+			}
+			broker.scheduler.OnElected(func() {
+				if _, err := broker.ReloadSchedules(); err != nil {
+					log.WithError(err).Error("Reload schedule file error")
+				}
+			})
+		}
 	}
 	go broker.handleSignals()
 	return broker, nil
@@ -82,8 +211,12 @@ func (b *Broker) ServeLoop(addr string) {
 	go b.group.ServeLoop()
 	if b.config.Scheduler {
 		go b.scheduler.ServeLoop()
+		if len(b.config.ScheduleFile) > 0 {
+			go b.watchScheduleFile()
+		}
 	}
 	go b.ServeHttp(addr, ch)
+	go b.pingLoop()
 	go b.inspector.ServeLoop()
 	log.Error(<-ch)
 }
@@ -143,12 +276,8 @@ func (b *Broker) newHttpServer() http.Handler {
 		m.Try = 0
 
 		if err := b.Enqueue(m.GetWorkQueue(), &m); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			resp := response{
-				Ok:   false,
-				Err:  err.Error(),
-				Code: 101,
-			}
+			status, resp := b.newWriteErrorResponse(err)
+			w.WriteHeader(status)
 			json.NewEncoder(w).Encode(&resp)
 		} else {
 			w.WriteHeader(http.StatusOK)
@@ -185,6 +314,7 @@ func (b *Broker) newHttpServer() http.Handler {
 		m.Timestamp = time.Now().Unix()
 		m.Try = 0
 		m.Queue = req.Queue
+		m.Tags = req.Tags
 		d, err := time.ParseDuration(req.Delay)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -196,7 +326,15 @@ func (b *Broker) newHttpServer() http.Handler {
 			json.NewEncoder(w).Encode(&resp)
 			return
 		}
-		b.scheduler.Delay(&m, d)
+		if len(req.Name) > 0 {
+			m.Id = req.Name
+		}
+		if err := b.Delay(&m, d); err != nil {
+			status, resp := b.newWriteErrorResponse(err)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		resp := response{
 			Ok:      true,
@@ -230,6 +368,7 @@ func (b *Broker) newHttpServer() http.Handler {
 		m.Timestamp = time.Now().Unix()
 		m.Try = 0
 		m.Queue = req.Queue
+		m.Tags = req.Tags
 		p, err := NewPeriod(req.Period)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -241,7 +380,17 @@ func (b *Broker) newHttpServer() http.Handler {
 			json.NewEncoder(w).Encode(&resp)
 			return
 		}
-		b.scheduler.Period(&m, p)
+		if len(req.Name) > 0 {
+			err = b.Register(req.Name, &m, p)
+		} else {
+			err = b.Period(&m, p)
+		}
+		if err != nil {
+			status, resp := b.newWriteErrorResponse(err)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		resp := response{
 			Ok:      true,
@@ -275,7 +424,8 @@ func (b *Broker) newHttpServer() http.Handler {
 		m.Timestamp = time.Now().Unix()
 		m.Try = 0
 		m.Queue = req.Queue
-		cron, err := NewCrontab(req.Crontab)
+		m.Tags = req.Tags
+		cron, err := NewCrontabIn(req.Crontab, req.Timezone)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			resp := response{
@@ -286,7 +436,17 @@ func (b *Broker) newHttpServer() http.Handler {
 			json.NewEncoder(w).Encode(&resp)
 			return
 		}
-		b.scheduler.Crontab(&m, cron)
+		if len(req.Name) > 0 {
+			err = b.Register(req.Name, &m, cron)
+		} else {
+			err = b.Crontab(&m, cron)
+		}
+		if err != nil {
+			status, resp := b.newWriteErrorResponse(err)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		resp := response{
 			Ok:      true,
@@ -296,6 +456,18 @@ func (b *Broker) newHttpServer() http.Handler {
 	})
 
 	mux.HandleFunc("/v1/schedular/list", b.newHTTPHandlerForSchedularList())
+	mux.HandleFunc("/v1/health", b.newHTTPHandlerForHealth())
+	mux.HandleFunc("/v1/schedules/export", b.newHTTPHandlerForScheduleExport())
+	mux.HandleFunc("/v1/schedules/import", b.newHTTPHandlerForScheduleImport())
+	mux.HandleFunc("/v1/schedules/cancel", b.newHTTPHandlerForScheduleCancel())
+	mux.HandleFunc("/v1/schedules/pause/", b.newHTTPHandlerForSchedulePause("/v1/schedules/pause/", b.PauseSchedule))
+	mux.HandleFunc("/v1/schedules/resume/", b.newHTTPHandlerForSchedulePause("/v1/schedules/resume/", b.ResumeSchedule))
+	mux.HandleFunc("/v1/schedules/", b.newHTTPHandlerForSchedule("/v1/schedules/"))
+	mux.HandleFunc("/v1/workers", b.newHTTPHandlerForWorkers())
+	mux.HandleFunc("/v1/stats", b.newHTTPHandlerForStats())
+	mux.HandleFunc("/v1/queues/pause/", b.newHTTPHandlerForQueuePause("/v1/queues/pause/", b.PauseQueue))
+	mux.HandleFunc("/v1/queues/resume/", b.newHTTPHandlerForQueuePause("/v1/queues/resume/", b.ResumeQueue))
+	mux.HandleFunc("/v1/queues/paused", b.newHTTPHandlerForPausedQueues())
 
 	return mux
 }
@@ -306,35 +478,644 @@ func (b *Broker) newHTTPHandlerForSchedularList() func(w http.ResponseWriter, re
 	}
 }
 
+// 降级模式下返回503
+func (b *Broker) newHTTPHandlerForHealth() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server", "mataq/1.0")
+		health := b.Health()
+		if health.Degraded {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	}
+}
+
+// 使用 tenant 参数查询租户的队列
+func (b *Broker) newHTTPHandlerForStats() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server", "mataq/1.0")
+		stats, err := b.Stats(req.URL.Query().Get("tenant"))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			resp := response{
+				Ok:   false,
+				Err:  err.Error(),
+				Code: 111,
+			}
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
+		json.NewEncoder(w).Encode(stats)
+	}
+}
+
+func (b *Broker) newHTTPHandlerForScheduleExport() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server", "mataq/1.0")
+		d, err := b.ExportSchedules()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			resp := response{
+				Ok:   false,
+				Err:  err.Error(),
+				Code: 112,
+			}
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
+		json.NewEncoder(w).Encode(d)
+	}
+}
+
+// mode=replace 时先取消所有已有的任务
+func (b *Broker) newHTTPHandlerForScheduleImport() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server", "mataq/1.0")
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var d ScheduleDump
+		if err := json.NewDecoder(req.Body).Decode(&d); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			resp := response{
+				Ok:   false,
+				Err:  err.Error(),
+				Code: 100,
+			}
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
+		n, err := b.ImportSchedules(&d, req.URL.Query().Get("mode") == "replace")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			resp := response{
+				Ok:   false,
+				Err:  err.Error(),
+				Code: 113,
+			}
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "imported": n})
+	}
+}
+
+func (b *Broker) newHTTPHandlerForSchedule(prefix string) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server", "mataq/1.0")
+		id := req.URL.Path[len(prefix):]
+		var (
+			e   *ScheduleEntry
+			err error
+		)
+		switch req.Method {
+		case http.MethodGet:
+			e, err = b.GetSchedule(id)
+		case http.MethodPatch:
+			var u *ScheduleUpdate
+			if u, err = newScheduleUpdate(req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				resp := response{
+					Ok:      false,
+					Err:     err.Error(),
+					Code:    100,
+					EventId: id,
+				}
+				json.NewEncoder(w).Encode(&resp)
+				return
+			}
+			e, err = b.UpdateSchedule(id, u)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch err {
+			case ErrScheduleNotFound:
+				status = http.StatusNotFound
+			case ErrAlreadyDispatched:
+				status = http.StatusConflict
+			case ErrConflictingUpdate, ErrNotPositive:
+				status = http.StatusBadRequest
+			}
+			w.WriteHeader(status)
+			resp := response{
+				Ok:      false,
+				Err:     err.Error(),
+				Code:    114,
+				EventId: id,
+			}
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
+		json.NewEncoder(w).Encode(e)
+	}
+}
+
+// 解析修改任务的请求
+func newScheduleUpdate(req *http.Request) (*ScheduleUpdate, error) {
+	var r scheduleUpdateRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	u := &ScheduleUpdate{Once: r.Once, Queue: r.Queue}
+	if r.At > 0 {
+		u.At = time.Unix(r.At, 0)
+	}
+	if len(r.Delay) > 0 {
+		d, err := time.ParseDuration(r.Delay)
+		if err != nil {
+			return nil, err
+		}
+		u.Delay = d
+	}
+	if r.Period != 0 {
+		p, err := NewPeriod(r.Period)
+		if err != nil {
+			return nil, err
+		}
+		u.Period = p
+	}
+	if len(r.Crontab) > 0 {
+		cron, err := NewCrontabIn(r.Crontab, r.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		u.Crontab = cron
+	}
+	if len(r.Data) > 0 {
+		if err := json.Unmarshal(r.Data, &u.Data); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+func (b *Broker) newHTTPHandlerForSchedulePause(prefix string, f func(string) (*ScheduleEntry, error)) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server", "mataq/1.0")
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := req.URL.Path[len(prefix):]
+		e, err := f(id)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch err {
+			case ErrScheduleNotFound:
+				status = http.StatusNotFound
+			case ErrAlreadyDispatched:
+				status = http.StatusConflict
+			case ErrNotRecurring:
+				status = http.StatusBadRequest
+			}
+			w.WriteHeader(status)
+			resp := response{
+				Ok:      false,
+				Err:     err.Error(),
+				Code:    116,
+				EventId: id,
+			}
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
+		json.NewEncoder(w).Encode(e)
+	}
+}
+
+// 使用 event、queue 和 tag 参数筛选需要取消的任务
+func (b *Broker) newHTTPHandlerForScheduleCancel() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server", "mataq/1.0")
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		q := req.URL.Query()
+		n, err := b.CancelSchedules(&ScheduleFilter{
+			Event: q.Get("event"),
+			Queue: q.Get("queue"),
+			Tag:   q.Get("tag"),
+		})
+		if err != nil {
+			status := http.StatusInternalServerError
+			if err == ErrEmptyFilter {
+				status = http.StatusBadRequest
+			}
+			w.WriteHeader(status)
+			resp := response{
+				Ok:   false,
+				Err:  err.Error(),
+				Code: 115,
+			}
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "canceled": n})
+	}
+}
+
+func (b *Broker) newHTTPHandlerForWorkers() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server", "mataq/1.0")
+		workers, err := b.Workers()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			resp := response{
+				Ok:   false,
+				Err:  err.Error(),
+				Code: 106,
+			}
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
+		json.NewEncoder(w).Encode(workers)
+	}
+}
+
+// 暂停或恢复队列，请求参数 scope=local 时只对当前代理生效
+func (b *Broker) newHTTPHandlerForQueuePause(prefix string, f func(string, bool) error) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server", "mataq/1.0")
+		queue := req.URL.Path[len(prefix):]
+		if len(queue) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			resp := response{
+				Ok:   false,
+				Err:  "queue required",
+				Code: 107,
+			}
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
+		if err := f(queue, req.URL.Query().Get("scope") == "local"); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			resp := response{
+				Ok:   false,
+				Err:  err.Error(),
+				Code: 108,
+			}
+			json.NewEncoder(w).Encode(&resp)
+			return
+		}
+		json.NewEncoder(w).Encode(&response{Ok: true})
+	}
+}
+
+func (b *Broker) newHTTPHandlerForPausedQueues() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server", "mataq/1.0")
+		json.NewEncoder(w).Encode(b.PausedQueues())
+	}
+}
+
+// PauseQueue 暂停消费队列，暂停期间仍然可以写入消息
+// local 为 false 时通过 Redis 对整个集群生效
+func (b *Broker) PauseQueue(queue string, local bool) error {
+	return b.group.PauseQueue(queue, local)
+}
+
+// ResumeQueue 恢复消费队列
+func (b *Broker) ResumeQueue(queue string, local bool) error {
+	return b.group.ResumeQueue(queue, local)
+}
+
+// PausedQueues 返回被暂停的队列
+func (b *Broker) PausedQueues() *PausedQueues {
+	return b.group.PausedQueues()
+}
+
+// Workers 列出集群中所有存活的 Worker
+func (b *Broker) Workers() ([]*WorkerInfo, error) {
+	return listWorkers(b.backend, b.group.options.WorkerTTL)
+}
+
+// 写入队列或者调度器前校验、编码消息数据并签名
+func (b *Broker) prepare(m *Message, pinned bool) error {
+	return b.prepareWith(m, pinned, b.payload.encode)
+}
+
+// 替换任务的数据前校验、编码并签名，数据转存到新的键，替换成功后才回收旧的数据
+func (b *Broker) prepareReplacement(m *Message, pinned bool) error {
+	return b.prepareWith(m, pinned, b.payload.encodeReplacement)
+}
+
+func (b *Broker) prepareWith(m *Message, pinned bool, encode func(m *Message, pinned bool) error) error {
+	if err := b.encodeWith(m, pinned, encode); err != nil {
+		return err
+	}
+	return b.sign(m)
+}
+
+// 校验并编码消息数据，不签名
+func (b *Broker) encodeWith(m *Message, pinned bool, encode func(m *Message, pinned bool) error) error {
+	if b.config.Upcasters != nil && m.Version == 0 {
+		m.Version = b.config.Upcasters.CurrentVersion(m.Event)
+	}
+	if b.config.Schemas != nil {
+		if err := b.config.Schemas.Validate(m.Event, m.Data); err != nil {
+			return err
+		}
+	}
+	if err := encode(m, pinned); err != nil {
+		return err
+	}
+	if len(b.config.ContentType) > 0 {
+		m.ContentType = b.config.ContentType
+	}
+	return nil
+}
+
+func (b *Broker) sign(m *Message) error {
+	if b.config.Signer != nil {
+		return b.config.Signer.Sign(m)
+	}
+	return nil
+}
+
 func (b *Broker) Enqueue(queue string, m *Message) error {
-	data, err := json.Marshal(m)
+	if err := b.prepare(m, false); err != nil {
+		return err
+	}
+	data, err := marshalMessage(m)
 	if err != nil {
 		return err
 	}
-	cmd := b.redis.RPush(queue, data)
-	return cmd.Err()
+	return b.backend.Push(queue, data)
+}
+
+// Drain 同步处理队列中所有的消息，返回处理的消息数量，用于测试
+func (b *Broker) Drain() int {
+	return b.group.Drain()
+}
+
+// Result 查询消息的处理结果，还没有结果时返回 ErrNil
+func (b *Broker) Result(id string) (*Result, error) {
+	return b.TenantResult("", id)
+}
+
+// TenantResult 查询租户消息的处理结果
+func (b *Broker) TenantResult(tenant, id string) (*Result, error) {
+	data, err := b.backend.Get(tenantKey(tenant, id))
+	if err != nil {
+		return nil, err
+	}
+	var v Result
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Messages 列出队列中的消息，queue 是完整的队列名称，例如 DefaultFailedQueue
+func (b *Broker) Messages(queue string) ([]*Message, error) {
+	values, err := b.backend.Range(queue, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]*Message, 0, len(values))
+	for _, v := range values {
+		m, err := unmarshalMessage(v)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, m)
+	}
+	return rv, nil
+}
+
+// QueueStats 队列中的消息数量
+type QueueStats struct {
+	Tenant     string           `json:"tenant,omitempty"`
+	Queues     map[string]int64 `json:"queues"`
+	Failed     int64            `json:"failed"`
+	Quarantine int64            `json:"quarantine"`
+	Unhandled  int64            `json:"unhandled"`
+	// 调度器执行任务的统计，只在开启调度器并且不指定租户时返回
+	Scheduler *DispatchMetrics `json:"scheduler,omitempty"`
+}
+
+// Stats 统计租户各个队列中的消息数量，tenant 为空时统计没有租户的队列
+func (b *Broker) Stats(tenant string) (*QueueStats, error) {
+	v := &QueueStats{Tenant: tenant, Queues: make(map[string]int64)}
+	for _, q := range b.config.Queues {
+		n, err := b.backend.Len(tenantQueueName(tenant, q))
+		if err != nil {
+			return nil, err
+		}
+		v.Queues[q] = n
+	}
+	for _, item := range []struct {
+		queue string
+		n     *int64
+	}{
+		{DefaultFailedQueue, &v.Failed},
+		{DefaultQuarantineQueue, &v.Quarantine},
+		{b.config.Unhandled.moveQueue(), &v.Unhandled},
+	} {
+		n, err := b.backend.Len(tenantKey(tenant, item.queue))
+		if err != nil {
+			return nil, err
+		}
+		*item.n = n
+	}
+	if len(tenant) == 0 && b.SchedularAvaiable() {
+		m := b.scheduler.Metrics()
+		v.Scheduler = &m
+	}
+	return v, nil
 }
 
 func (b *Broker) AddEventHandler(event string, handler EventHandler) {
 	b.group.AddEventHandler(event, handler)
 }
 
-func (b *Broker) Delay(m *Message, d time.Duration) {
-	if b.config.Scheduler {
-		b.scheduler.Delay(m, d)
+func (b *Broker) Delay(m *Message, d time.Duration) error {
+	if !b.config.Scheduler {
+		return ErrSchedulerDisabled
+	}
+	if err := b.prepare(m, false); err != nil {
+		return err
 	}
+	b.scheduler.Delay(m, d)
+	return nil
 }
 
-func (b *Broker) Period(m *Message, p *Period) {
-	if b.config.Scheduler {
-		b.scheduler.Period(m, p)
+func (b *Broker) Period(m *Message, p *Period) error {
+	if !b.config.Scheduler {
+		return ErrSchedulerDisabled
+	}
+	if err := b.prepare(m, true); err != nil {
+		return err
 	}
+	b.scheduler.Period(m, p)
+	return nil
 }
 
-func (b *Broker) Crontab(m *Message, cron *Crontab) {
-	if b.config.Scheduler {
-		b.scheduler.Crontab(m, cron)
+func (b *Broker) Crontab(m *Message, cron *Crontab) error {
+	if !b.config.Scheduler {
+		return ErrSchedulerDisabled
+	}
+	if err := b.prepare(m, true); err != nil {
+		return err
+	}
+	b.scheduler.Crontab(m, cron)
+	return nil
+}
+
+// GetSchedule 按编号查找调度器中的任务
+func (b *Broker) GetSchedule(id string) (*ScheduleEntry, error) {
+	if !b.SchedularAvaiable() {
+		return nil, ErrSchedulerDisabled
+	}
+	pm, ok := b.scheduler.Get(id)
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+	return newScheduleEntry(pm)
+}
+
+// UpdateSchedule 修改任务，修改数据时重新编码消息，开启签名时重新签名
+func (b *Broker) UpdateSchedule(id string, u *ScheduleUpdate) (*ScheduleEntry, error) {
+	if !b.SchedularAvaiable() {
+		return nil, ErrSchedulerDisabled
+	}
+	// 新的数据在锁外校验、编码和转存，锁内只替换字段，避免慢的存储阻塞调度器
+	var data *Message
+	if u.Data != nil {
+		cur, ok := b.scheduler.Get(id)
+		if !ok {
+			return nil, ErrScheduleNotFound
+		}
+		data = &Message{Id: cur.Id, Event: cur.Event, Tenant: cur.Tenant, Data: u.Data}
+		if err := b.encodeWith(data, false, b.payload.encodeReplacement); err != nil {
+			b.releaseSchedule(data)
+			return nil, err
+		}
+	}
+
+	var old *Message
+	pm, err := b.scheduler.update(id, func(pm *PriorityMessage) error {
+		v := pm.Message
+		if err := u.apply(pm, time.Now()); err != nil {
+			return err
+		}
+		if data != nil {
+			pm.Data, pm.DataRef, pm.Encoding, pm.KeyId = data.Data, data.DataRef, data.Encoding, data.KeyId
+			pm.Version = data.Version
+			// 周期任务的数据会被重复使用，不能在执行后删除
+			pm.DataPinned = len(pm.DataRef) > 0 && pm.IsPeriodic()
+			old = &v
+		}
+		return b.sign(&pm.Message)
+	})
+	if err != nil {
+		// 新的数据没有被使用
+		if data != nil {
+			b.releaseSchedule(data)
+		}
+		return nil, err
+	}
+	if old != nil && old.DataRef != pm.DataRef {
+		b.releaseSchedule(old)
+	}
+	return newScheduleEntry(pm)
+}
+
+// PauseSchedule 暂停周期任务
+func (b *Broker) PauseSchedule(id string) (*ScheduleEntry, error) {
+	if !b.SchedularAvaiable() {
+		return nil, ErrSchedulerDisabled
+	}
+	pm, err := b.scheduler.Pause(id)
+	if err != nil {
+		return nil, err
+	}
+	return newScheduleEntry(pm)
+}
+
+// ResumeSchedule 恢复暂停的周期任务
+func (b *Broker) ResumeSchedule(id string) (*ScheduleEntry, error) {
+	if !b.SchedularAvaiable() {
+		return nil, ErrSchedulerDisabled
+	}
+	pm, err := b.scheduler.Resume(id)
+	if err != nil {
+		return nil, err
+	}
+	return newScheduleEntry(pm)
+}
+
+// CancelSchedules 取消所有匹配的任务，返回取消的数量
+func (b *Broker) CancelSchedules(f *ScheduleFilter) (int, error) {
+	if !b.SchedularAvaiable() {
+		return 0, ErrSchedulerDisabled
 	}
+	return b.scheduler.CancelMatching(f)
+}
+
+// Register 按名称添加或者更新周期任务，p 为 *Period 或者 *Crontab
+// 服务启动时注册任务，重复注册同一个名称不会产生重复的任务
+func (b *Broker) Register(name string, m *Message, p Periodicor) error {
+	if !b.config.Scheduler {
+		return ErrSchedulerDisabled
+	}
+	m.Id = name
+	if err := b.prepareReplacement(m, true); err != nil {
+		b.releaseSchedule(m)
+		return err
+	}
+	_, old, err := b.scheduler.register(name, m, p)
+	if err != nil {
+		// 新的数据没有被使用
+		b.releaseSchedule(m)
+		return err
+	}
+	if old != nil && old.DataRef != m.DataRef {
+		b.releaseSchedule(old)
+	}
+	return nil
+}
+
+// 回收任务的数据，周期任务的数据是固定的，执行后不会回收，只在取消或者替换时回收
+func (b *Broker) releaseSchedule(m *Message) {
+	if len(m.DataRef) == 0 {
+		return
+	}
+	v := *m
+	v.DataPinned = false
+	if err := b.payload.release(&v); err != nil {
+		log.WithError(err).WithField("eventId", m.Id).Error("Release payload error")
+	}
+}
+
+// ExportSchedules 导出调度器中所有的任务
+func (b *Broker) ExportSchedules() (*ScheduleDump, error) {
+	if !b.SchedularAvaiable() {
+		return nil, ErrSchedulerDisabled
+	}
+	return b.scheduler.Export()
+}
+
+// ImportSchedules 导入任务，replace 为 true 时先取消所有已有的任务
+func (b *Broker) ImportSchedules(d *ScheduleDump, replace bool) (int, error) {
+	if !b.SchedularAvaiable() {
+		return 0, ErrSchedulerDisabled
+	}
+	return b.scheduler.Import(d, replace)
 }
 
 func (b *Broker) Dumps() error {
@@ -356,6 +1137,9 @@ func (b *Broker) handleSignals() {
 		if err := b.scheduler.dumps(); err != nil {
 			log.Error("调度器保存错误: ", err)
 		}
+		if err := b.scheduler.resign(); err != nil {
+			log.Error("调度器释放租约错误: ", err)
+		}
 	}
 	b.group.cleanup()
 	os.Exit(0)
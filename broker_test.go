@@ -0,0 +1,143 @@
+package maatq
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestBroker(t *testing.T, config *BrokerOptions) *Broker {
+	config.Backend = NewMemoryBackend()
+	config.Parallel = 1
+	if len(config.Queues) == 0 {
+		config.Queues = []string{"default"}
+	}
+	b, err := NewBroker(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBrokerWithMemoryBackend(t *testing.T) {
+	b := newTestBroker(t, &BrokerOptions{Try: 1})
+	b.AddEventHandler("hello", func(arg interface{}) (interface{}, error) {
+		s, err := AtoString(arg)
+		if err != nil {
+			return nil, err
+		}
+		return "hello " + s, nil
+	})
+	b.AddEventHandler("fail", func(arg interface{}) (interface{}, error) {
+		return nil, errors.New("boom")
+	})
+
+	b.Enqueue(DefaultQueue, &Message{Id: "ID(1)", Event: "hello", Data: "yuez"})
+	b.Enqueue(DefaultQueue, &Message{Id: "ID(2)", Event: "fail"})
+
+	// 失败的消息重试一次后进入失败队列
+	if n := b.Drain(); n != 3 {
+		t.Error("处理的消息数量错误: ", n)
+	}
+
+	r, err := b.Result("ID(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Success || r.Data != "hello yuez" {
+		t.Error("处理结果错误: ", r)
+	}
+
+	r, _ = b.Result("ID(2)")
+	if r.Success || r.Error != "boom" {
+		t.Error("处理结果错误: ", r)
+	}
+	failed, err := b.Messages(DefaultFailedQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Id != "ID(2)" || failed[0].Try != 1 {
+		t.Error("失败队列错误: ", failed)
+	}
+
+	if _, err := b.Result("ID(3)"); err != ErrNil {
+		t.Error("没有结果时应该返回 ErrNil: ", err)
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	b := NewMemoryBackend()
+	b.Push("q1", []byte("a"))
+	b.Push("q2", []byte("b"))
+	b.PushFront("q2", []byte("c"))
+
+	if values, _ := b.Range("q2", 0, -1); len(values) != 2 || string(values[0]) != "c" {
+		t.Error("Range 错误: ", values)
+	}
+
+	// 按队列顺序取出消息
+	for _, expected := range []string{"c", "b", "a"} {
+		_, v, err := b.Pop(drainPollTimeout, "q2", "q1")
+		if err != nil || string(v) != expected {
+			t.Errorf("Pop 错误: expected[%s] got[%s] %v", expected, v, err)
+		}
+	}
+	if _, _, err := b.Pop(drainPollTimeout, "q1", "q2"); err != ErrNil {
+		t.Error("空队列应该超时: ", err)
+	}
+
+	done := make(chan string)
+	go func() {
+		_, v, _ := b.Pop(0, "q1")
+		done <- string(v)
+	}()
+	b.Push("q1", []byte("d"))
+	if v := <-done; v != "d" {
+		t.Error("等待中的 Pop 应该被唤醒: ", v)
+	}
+
+	b.ZAdd("z", 2, "b")
+	b.ZAdd("z", 1, "a")
+	b.ZAdd("z", 3, "c")
+	b.ZRemRangeByScore("z", 0, 1)
+	if v, _ := b.ZRangeByScore("z", 0, 10); len(v) != 2 || v[0] != "b" {
+		t.Error("ZRangeByScore 错误: ", v)
+	}
+}
+
+func TestBrokerScheduleAPI(t *testing.T) {
+	b := newTestBroker(t, &BrokerOptions{Scheduler: true})
+	handler := b.newHttpServer()
+	b.Delay(&Message{Id: "ID(1)", Event: "hello", Tags: []string{"billing"}}, time.Hour)
+	b.Delay(&Message{Id: "ID(2)", Event: "hello"}, time.Hour)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v1/schedules/ID(1)", nil))
+	var e ScheduleEntry
+	json.NewDecoder(w.Body).Decode(&e)
+	if w.Code != http.StatusOK || e.Message == nil || e.Message.Id != "ID(1)" {
+		t.Error("查询任务错误: ", w.Code, e)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v1/schedules/ID(3)", nil))
+	if w.Code != http.StatusNotFound {
+		t.Error("任务不存在时应该返回404: ", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/v1/schedules/cancel", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Error("没有条件时应该返回400: ", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/v1/schedules/cancel?tag=billing", nil))
+	if _, ok := b.scheduler.Get("ID(1)"); ok || w.Code != http.StatusOK {
+		t.Error("按标签取消任务错误: ", w.Code)
+	}
+	if _, ok := b.scheduler.Get("ID(2)"); !ok {
+		t.Error("不匹配的任务不应该被取消")
+	}
+}
@@ -0,0 +1,337 @@
+package maatq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 消息在队列中的序列化格式
+// 不同格式的消息可以写入同一个队列，读取时按以下规则判断格式:
+//     - JSON 不加头部，以 { 开头，允许前面有空白
+//     - 其他格式以 0x00 和 content type 开头，content type 的长度为 varint，
+//       读取时在注册的格式中查找
+//     - 没有头部的 MessagePack 和 Protobuf 消息是旧版本写入的，根据第一个字节判断
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeProtobuf = "application/protobuf"
+
+	// 非 JSON 格式的消息头部的第一个字节
+	codecFrameMagic = 0x00
+)
+
+var (
+	ErrUnknownContentType = errors.New("unknown message content type")
+)
+
+// Codec 消息的序列化格式
+type Codec interface {
+	ContentType() string
+	Marshal(m *Message) ([]byte, error)
+	Unmarshal(b []byte, m *Message) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(&jsonCodec{})
+	RegisterCodec(&msgpackCodec{})
+	RegisterCodec(&protobufCodec{})
+}
+
+// RegisterCodec 注册序列化格式
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.ContentType()] = c
+}
+
+// GetCodec 根据 content type 获取序列化格式，为空时使用 JSON
+func GetCodec(contentType string) (Codec, error) {
+	if len(contentType) == 0 {
+		contentType = ContentTypeJSON
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("%v: %s", ErrUnknownContentType, contentType)
+	}
+	return c, nil
+}
+
+// 按消息的 content_type 序列化消息，非 JSON 格式加上头部
+func marshalMessage(m *Message) ([]byte, error) {
+	c, err := GetCodec(m.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.Marshal(m)
+	if err != nil || c.ContentType() == ContentTypeJSON {
+		return b, err
+	}
+	rv := make([]byte, 0, 2+len(c.ContentType())+len(b))
+	rv = append(rv, codecFrameMagic)
+	rv = protowire.AppendString(rv, c.ContentType())
+	return append(rv, b...), nil
+}
+
+// 判断格式并反序列化消息
+func unmarshalMessage(b []byte) (*Message, error) {
+	var m Message
+	contentType, body, err := detectContentType(b)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := GetCodec(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if err := codec.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// 返回消息的格式和去掉头部的内容
+func detectContentType(b []byte) (string, []byte, error) {
+	b = bytes.TrimLeft(b, " \t\r\n")
+	if len(b) == 0 {
+		return "", nil, ErrUnknownContentType
+	}
+	switch c := b[0]; {
+	case c == codecFrameMagic:
+		contentType, n := protowire.ConsumeString(b[1:])
+		if n < 0 || len(contentType) == 0 {
+			return "", nil, ErrUnknownContentType
+		}
+		return contentType, b[1+n:], nil
+	case c == '{':
+		return ContentTypeJSON, b, nil
+	case c >= 0x80 && c <= 0x8f, c == 0xde, c == 0xdf:
+		return ContentTypeMsgpack, b, nil
+	case c == 0x0a:
+		return ContentTypeProtobuf, b, nil
+	}
+	return "", nil, ErrUnknownContentType
+}
+
+type jsonCodec struct{}
+
+func (c *jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (c *jsonCodec) Marshal(m *Message) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (c *jsonCodec) Unmarshal(b []byte, m *Message) error {
+	return json.Unmarshal(b, m)
+}
+
+// MessagePack 格式，字段名和 JSON 相同
+type msgpackCodec struct{}
+
+func (c *msgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+func (c *msgpackCodec) Marshal(m *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	e := msgpack.NewEncoder(&buf)
+	e.SetCustomStructTag("json")
+	if err := e.Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 数据转换成 JSON 的类型，例如数字都是 float64，处理函数和 Schema 校验看到的数据和格式无关
+func (c *msgpackCodec) Unmarshal(b []byte, m *Message) error {
+	d := msgpack.NewDecoder(bytes.NewReader(b))
+	d.SetCustomStructTag("json")
+	if err := d.Decode(m); err != nil {
+		return err
+	}
+	if m.Data == nil {
+		return nil
+	}
+	data, err := json.Marshal(m.Data)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	m.Data = v
+	return nil
+}
+
+// Protobuf 格式，对应的定义如下，data 字段保存 JSON 编码的消息数据:
+//
+//	message Message {
+//	    string content_type = 1;
+//	    string id = 2;
+//	    string event = 3;
+//	    int64 timestamp = 4;
+//	    int64 try = 5;
+//	    bytes data = 6;
+//	    string queue = 7;
+//	    string data_ref = 8;
+//	    bool data_pinned = 9;
+//	    string encoding = 10;
+//	    string key_id = 11;
+//	    string producer = 12;
+//	    string sig_key = 13;
+//	    string sig = 14;
+//	    int64 version = 15;
+//	    string tenant = 16;
+//	    repeated string tags = 17;
+//	}
+type protobufCodec struct{}
+
+func (c *protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+// 消息中的字符串字段和编号
+func protobufStringFields(m *Message) []struct {
+	num protowire.Number
+	v   *string
+} {
+	return []struct {
+		num protowire.Number
+		v   *string
+	}{
+		{2, &m.Id},
+		{3, &m.Event},
+		{7, &m.Queue},
+		{8, &m.DataRef},
+		{10, &m.Encoding},
+		{11, &m.KeyId},
+		{12, &m.Producer},
+		{13, &m.SigKey},
+		{14, &m.Signature},
+		{16, &m.Tenant},
+	}
+}
+
+func (c *protobufCodec) Marshal(m *Message) ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, c.ContentType())
+	for _, f := range protobufStringFields(m) {
+		if len(*f.v) > 0 {
+			b = protowire.AppendTag(b, f.num, protowire.BytesType)
+			b = protowire.AppendString(b, *f.v)
+		}
+	}
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.Timestamp))
+	b = protowire.AppendTag(b, 5, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.Try))
+	if m.Data != nil {
+		data, err := json.Marshal(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, data)
+	}
+	if m.DataPinned {
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	if m.Version > 0 {
+		b = protowire.AppendTag(b, 15, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Version))
+	}
+	for _, tag := range m.Tags {
+		b = protowire.AppendTag(b, 17, protowire.BytesType)
+		b = protowire.AppendString(b, tag)
+	}
+	return b, nil
+}
+
+func (c *protobufCodec) Unmarshal(b []byte, m *Message) error {
+	fields := make(map[protowire.Number]*string)
+	for _, f := range protobufStringFields(m) {
+		fields[f.num] = f.v
+	}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			m.ContentType = v
+			b = b[n:]
+		case fields[num] != nil && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*fields[num] = v
+			b = b[n:]
+		case num == 17 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			m.Tags = append(m.Tags, v)
+			b = b[n:]
+		case num == 6 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if err := json.Unmarshal(v, &m.Data); err != nil {
+				return err
+			}
+			b = b[n:]
+		case (num == 4 || num == 5 || num == 9 || num == 15) && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			switch num {
+			case 4:
+				m.Timestamp = int64(v)
+			case 5:
+				m.Try = int(v)
+			case 9:
+				m.DataPinned = protowire.DecodeBool(v)
+			case 15:
+				m.Version = int(v)
+			}
+			b = b[n:]
+		default:
+			// 跳过未知的字段
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
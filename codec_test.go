@@ -0,0 +1,109 @@
+package maatq
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	for _, ct := range []string{ContentTypeJSON, ContentTypeMsgpack, ContentTypeProtobuf} {
+		m := &Message{
+			Id:          "ID(1)",
+			Event:       "hello",
+			Timestamp:   1257894000,
+			Try:         2,
+			Data:        map[string]interface{}{"name": "yuez"},
+			Queue:       "sms",
+			DataPinned:  true,
+			Encoding:    "gzip",
+			Signature:   "c2ln",
+			ContentType: ct,
+			Version:     3,
+			Tags:        []string{"billing", "daily"},
+		}
+		b, err := marshalMessage(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 不同格式的消息在同一个队列中，读取时自动识别
+		v, err := unmarshalMessage(b)
+		if err != nil {
+			t.Fatalf("[%s] %v", ct, err)
+		}
+		if !reflect.DeepEqual(v, m) {
+			t.Errorf("[%s] 反序列化的消息错误: %+v", ct, v)
+		}
+	}
+
+	if _, err := GetCodec("application/xml"); err == nil {
+		t.Error("未知的格式应该返回错误")
+	}
+	if _, err := unmarshalMessage([]byte("hello")); err == nil {
+		t.Error("无法识别的消息应该返回错误")
+	}
+	if m, err := unmarshalMessage([]byte(" \n{\"id\": \"ID(1)\"}")); err != nil || m.Id != "ID(1)" {
+		t.Error("JSON 前面的空白应该被忽略: ", err)
+	}
+	// 旧版本写入的没有头部的消息
+	b, _ := (&msgpackCodec{}).Marshal(&Message{Id: "ID(1)"})
+	if m, err := unmarshalMessage(b); err != nil || m.Id != "ID(1)" {
+		t.Error("应该识别没有头部的 MessagePack 消息: ", err)
+	}
+}
+
+// 只保存编号的格式，用于测试注册的格式
+type idCodec struct{}
+
+func (c *idCodec) ContentType() string {
+	return "application/x-id"
+}
+
+func (c *idCodec) Marshal(m *Message) ([]byte, error) {
+	return []byte(m.Id), nil
+}
+
+func (c *idCodec) Unmarshal(b []byte, m *Message) error {
+	m.Id = string(b)
+	m.ContentType = c.ContentType()
+	return nil
+}
+
+func TestRegisterCodec(t *testing.T) {
+	RegisterCodec(&idCodec{})
+	b, err := marshalMessage(&Message{Id: "{ID(1)}", ContentType: "application/x-id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := unmarshalMessage(b)
+	if err != nil || m.Id != "{ID(1)}" || m.ContentType != "application/x-id" {
+		t.Error("应该使用注册的格式反序列化: ", m, err)
+	}
+}
+
+// 不同格式的消息，处理函数收到的数据类型相同
+func TestCodecHandlerArguments(t *testing.T) {
+	data := map[string]interface{}{"n": 5, "price": 1.5, "ids": []interface{}{1, 2}, "user": map[string]interface{}{"age": 30}}
+	var expected interface{}
+	for _, ct := range []string{ContentTypeJSON, ContentTypeMsgpack, ContentTypeProtobuf} {
+		b := newTestBroker(t, &BrokerOptions{ContentType: ct})
+		var arg interface{}
+		b.AddEventHandler("hello", func(v interface{}) (interface{}, error) {
+			arg = v
+			return nil, nil
+		})
+		if err := b.Enqueue(DefaultQueue, &Message{Id: "ID(1)", Event: "hello", Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		b.Drain()
+		if expected == nil {
+			expected = arg
+			if n, ok := arg.(map[string]interface{})["n"].(float64); !ok || n != 5 {
+				t.Fatal("JSON 格式的数字应该是 float64: ", arg)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(arg, expected) {
+			t.Errorf("[%s] 处理函数收到的数据错误: %#v", ct, arg)
+		}
+	}
+}
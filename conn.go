@@ -0,0 +1,106 @@
+package maatq
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// 存储后端的连接容错：启动时重试，运行时退避，断开期间进入降级模式
+
+const (
+	DefaultConnectRetries = 5
+	DefaultBackoffMin     = 100 * time.Millisecond
+	DefaultBackoffMax     = 10 * time.Second
+
+	backendHealthItem = "Backend"
+)
+
+// 第 n 次连续失败后的等待时间，从 DefaultBackoffMin 开始翻倍，最多 DefaultBackoffMax
+func backoff(n int) time.Duration {
+	d := DefaultBackoffMin
+	for i := 1; i < n && d < DefaultBackoffMax; i++ {
+		d *= 2
+	}
+	if d > DefaultBackoffMax {
+		d = DefaultBackoffMax
+	}
+	return d
+}
+
+// 连接存储后端，失败时退避重试 retries 次，返回最后一次的错误
+func connect(backend Backend, retries int) error {
+	var err error
+	for n := 0; ; n++ {
+		if err = backend.Ping(); err == nil {
+			return nil
+		}
+		if n >= retries {
+			return err
+		}
+		d := backoff(n + 1)
+		log.WithError(err).Warnf("Backend unavailable, retry in %s", d)
+		time.Sleep(d)
+	}
+}
+
+// 定时检查存储后端，连接正常时刷新健康检查项
+func (b *Broker) pingLoop() {
+	for {
+		if err := b.backend.Ping(); err != nil {
+			log.WithError(err).Warn("Backend ping error")
+		} else {
+			b.backendHealth.Alive()
+		}
+		time.Sleep(b.inspector.interval)
+	}
+}
+
+// Degraded 存储后端断开时返回 true，此时消息无法写入和消费
+func (b *Broker) Degraded() bool {
+	b.backendHealth.mu.Lock()
+	defer b.backendHealth.mu.Unlock()
+	return !b.backendHealth.alive
+}
+
+// HealthItem 健康检查项的状态
+type HealthItem struct {
+	Name      string `json:"name"`
+	Alive     bool   `json:"alive"`
+	Comment   string `json:"comment"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Health 返回所有健康检查项的状态
+type Health struct {
+	Degraded bool          `json:"degraded"`
+	Items    []*HealthItem `json:"items"`
+}
+
+func (b *Broker) Health() *Health {
+	v := &Health{Degraded: b.Degraded()}
+	for _, i := range b.inspector.snapshot() {
+		i.mu.Lock()
+		v.Items = append(v.Items, &HealthItem{
+			Name:      i.name,
+			Alive:     i.alive,
+			Comment:   i.comment,
+			Timestamp: i.timestamp,
+		})
+		i.mu.Unlock()
+	}
+	return v
+}
+
+// 写入消息失败时的应答，降级模式下返回503
+func (b *Broker) newWriteErrorResponse(err error) (int, response) {
+	if b.Degraded() {
+		return http.StatusServiceUnavailable, response{
+			Ok:   false,
+			Err:  err.Error(),
+			Code: 110,
+		}
+	}
+	return newWriteErrorResponse(err)
+}
@@ -0,0 +1,92 @@
+package maatq
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Ping 前几次失败的内存后端
+type flakyBackend struct {
+	*MemoryBackend
+	failures int
+	pings    int
+}
+
+func (b *flakyBackend) Ping() error {
+	b.pings++
+	if b.pings <= b.failures {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestBackoff(t *testing.T) {
+	if d := backoff(1); d != DefaultBackoffMin {
+		t.Error("第一次等待时间错误: ", d)
+	}
+	if d := backoff(3); d != 4*DefaultBackoffMin {
+		t.Error("等待时间应该翻倍: ", d)
+	}
+	if d := backoff(100); d != DefaultBackoffMax {
+		t.Error("等待时间不应该超过最大值: ", d)
+	}
+}
+
+func TestConnectRetries(t *testing.T) {
+	b := &flakyBackend{MemoryBackend: NewMemoryBackend(), failures: 2}
+	if err := connect(b, 2); err != nil {
+		t.Error("重试后应该连接成功: ", err)
+	}
+
+	b = &flakyBackend{MemoryBackend: NewMemoryBackend(), failures: 2}
+	if err := connect(b, 1); err == nil {
+		t.Error("重试次数用完后应该返回错误")
+	}
+	if b.pings != 2 {
+		t.Error("尝试次数错误: ", b.pings)
+	}
+
+	_, err := NewWorkerGroup(&GroupOptions{
+		Backend:        &flakyBackend{MemoryBackend: NewMemoryBackend(), failures: 1},
+		Queues:         []string{"default"},
+		ConnectRetries: -1,
+	})
+	if err == nil {
+		t.Error("连接失败时应该返回错误")
+	}
+}
+
+func TestBrokerDegraded(t *testing.T) {
+	b := newTestBroker(t, &BrokerOptions{})
+	handler := b.newHttpServer()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v1/health", nil))
+	if w.Code != http.StatusOK {
+		t.Error("连接正常时应该返回200: ", w.Code)
+	}
+
+	b.backendHealth.timestamp = time.Now().Add(-time.Hour).Unix()
+	b.backendHealth.dead()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v1/health", nil))
+	var health Health
+	json.NewDecoder(w.Body).Decode(&health)
+	if w.Code != http.StatusServiceUnavailable || !health.Degraded {
+		t.Error("连接断开时应该进入降级模式: ", w.Code, health)
+	}
+
+	status, resp := b.newWriteErrorResponse(errors.New("connection refused"))
+	if status != http.StatusServiceUnavailable || resp.Code != 110 {
+		t.Error("降级模式下写入失败的应答错误: ", status, resp)
+	}
+
+	b.backendHealth.Alive()
+	if b.Degraded() {
+		t.Error("连接恢复后应该退出降级模式")
+	}
+}
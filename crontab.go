@@ -44,10 +44,27 @@ type Crontab struct {
 	Months      []int8 // 0 - 12
 	DaysOfWeek  []int8 // 0 - 7 (0或者7是周日, 或者使用名字)
 	Text        string // Cron字符串
+	Timezone    string // 时区，例如 Asia/Shanghai，为空时使用本地时区
+
+	location *time.Location
 }
 
+// Next 按时区计算下一次执行的时间
 func (cron *Crontab) Next() time.Time {
-	return cron.nextFrom(time.Now())
+	now := time.Now()
+	if loc := cron.getLocation(); loc != nil {
+		now = now.In(loc)
+	}
+	return cron.nextFrom(now)
+}
+
+// 时区在 NewCrontabIn 时加载，直接构造的 Crontab 每次重新加载
+func (cron *Crontab) getLocation() *time.Location {
+	if cron.location != nil || len(cron.Timezone) == 0 {
+		return cron.location
+	}
+	loc, _ := time.LoadLocation(cron.Timezone)
+	return loc
 }
 
 func (cron *Crontab) nextFrom(from time.Time) time.Time {
@@ -948,3 +965,16 @@ func NewCrontab(cron string) (*Crontab, error) {
 
 	return &v, nil
 }
+
+// NewCrontabIn 创建按指定时区执行的 Crontab，timezone 为空时使用本地时区
+func NewCrontabIn(cron, timezone string) (*Crontab, error) {
+	v, err := NewCrontab(cron)
+	if err != nil || len(timezone) == 0 {
+		return v, err
+	}
+	if v.location, err = time.LoadLocation(timezone); err != nil {
+		return nil, err
+	}
+	v.Timezone = timezone
+	return v, nil
+}
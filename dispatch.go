@@ -0,0 +1,170 @@
+package maatq
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// 调度器执行到期任务，每次 tick 执行所有到期的任务，
+// 消息分批写入工作队列，每批在一次往返中完成，并统计执行的延迟
+
+const (
+	// 每批写入工作队列的消息数量
+	dispatchBatchSize = 500
+	// 写入工作队列失败后重试的间隔
+	dispatchRetryInterval = time.Second
+)
+
+// DispatchMetrics 调度器执行任务的统计，延迟是任务到期到写入工作队列的时间
+type DispatchMetrics struct {
+	Dispatched     int64   `json:"dispatched"`       // 累计执行的任务数量
+	Errors         int64   `json:"errors"`           // 累计写入工作队列失败的次数
+	LastBatch      int     `json:"last_batch"`       // 最近一次执行的任务数量
+	LastLagMs      float64 `json:"last_lag_ms"`      // 最近一次执行的任务中最大的延迟
+	MaxLagMs       float64 `json:"max_lag_ms"`       // 启动以来最大的延迟
+	LastDispatchAt int64   `json:"last_dispatch_at"` // 最近一次执行任务的时间
+}
+
+type dispatchMetrics struct {
+	mu sync.Mutex
+	v  DispatchMetrics
+}
+
+// 记录一次执行，oldest 为执行的任务中最早的到期时间
+func (m *dispatchMetrics) record(n int, now time.Time, oldest int64) {
+	if n <= 0 {
+		return
+	}
+	lag := now.Sub(time.Unix(oldest, 0))
+	if lag < 0 {
+		lag = 0
+	}
+	ms := float64(lag) / float64(time.Millisecond)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.v.Dispatched += int64(n)
+	m.v.LastBatch = n
+	m.v.LastLagMs = ms
+	if ms > m.v.MaxLagMs {
+		m.v.MaxLagMs = ms
+	}
+	m.v.LastDispatchAt = now.Unix()
+}
+
+func (m *dispatchMetrics) fail() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.v.Errors++
+}
+
+// Metrics 返回执行任务的统计
+func (s *Scheduler) Metrics() DispatchMetrics {
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+	return s.metrics.v
+}
+
+// 取出所有到期的任务并分批写入工作队列，写入失败的任务放回堆中
+// 写入期间任务记录在 s.inflight 中，仍然可以按编号查找、取消和修改
+func (s *Scheduler) dispatchDue(now time.Time) (int, error) {
+	s.mu.Lock()
+	var due []*PriorityMessage
+	for s.heap.Len() > 0 && !(*s.heap.Items)[0].Paused && (*s.heap.Items)[0].T <= now.Unix() {
+		pm := heap.Pop(s.heap).(*PriorityMessage)
+		s.inflight[pm.Id] = pm
+		due = append(due, pm)
+	}
+	s.mu.Unlock()
+	if len(due) == 0 {
+		return 0, nil
+	}
+	oldest := due[0].T
+
+	n := 0
+	for len(due) > 0 {
+		size := len(due)
+		if size > dispatchBatchSize {
+			size = dispatchBatchSize
+		}
+		written, failed, err := s.dispatchBatch(due[:size])
+		n += written
+		if err != nil {
+			s.mu.Lock()
+			for _, pm := range append(failed, due[size:]...) {
+				if s.settle(pm) {
+					s.heap.upsert(pm)
+				}
+			}
+			s.mu.Unlock()
+			s.metrics.fail()
+			s.metrics.record(n, now, oldest)
+			return n, err
+		}
+		due = due[size:]
+	}
+	s.metrics.record(n, now, oldest)
+	return n, nil
+}
+
+// 结束任务的写入，返回任务是否需要放回堆中，写入期间被取消或者替换的任务返回 false
+// 调用时需要持有 s.mu
+func (s *Scheduler) settle(pm *PriorityMessage) bool {
+	if s.inflight[pm.Id] != pm {
+		return false
+	}
+	delete(s.inflight, pm.Id)
+	return true
+}
+
+// 把一批任务写入工作队列，返回写入的数量和没有写入的任务
+// 无法编码的消息永远不能执行，记录错误后丢弃
+// 整批任务只追加一项日志，在 s.mu 之外写入
+func (s *Scheduler) dispatchBatch(batch []*PriorityMessage) (int, []*PriorityMessage, error) {
+	entries := make([]QueueEntry, 0, len(batch))
+	pms := make([]*PriorityMessage, 0, len(batch))
+	var dropped []*PriorityMessage
+	for _, pm := range batch {
+		b, err := marshalMessage(&pm.Message)
+		if err != nil {
+			s.logger.WithFields(pm.ToLogFields()).WithError(err).Error("Marshal message error")
+			dropped = append(dropped, pm)
+			continue
+		}
+		entries = append(entries, QueueEntry{Queue: pm.GetWorkQueue(), Data: b})
+		pms = append(pms, pm)
+	}
+	written, err := pushBatch(s.backend, entries)
+
+	e := &JournalEntry{Op: JournalBatch}
+	s.mu.Lock()
+	for _, pm := range dropped {
+		s.settle(pm)
+	}
+	for _, pm := range pms[:written] {
+		if !s.settle(pm) {
+			continue
+		}
+		d := &JournalEntry{Op: JournalDispatch, Id: pm.Id}
+		if pm.IsPeriodic() {
+			pm.T = pm.P.Next().Unix()
+			s.heap.upsert(pm)
+			d.T = pm.T
+		}
+		e.Batch = append(e.Batch, d)
+	}
+	if written > 0 {
+		s.dirty = true
+	}
+	if s.journal == nil || len(e.Batch) == 0 {
+		s.mu.Unlock()
+		return written, pms[written:], err
+	}
+	// 先持有日志的锁再释放 s.mu，之后的修改在这一项之后写入日志
+	s.journalMu.Lock()
+	s.mu.Unlock()
+	s.writeJournal(e)
+	s.journalMu.Unlock()
+	return written, pms[written:], err
+}
@@ -0,0 +1,176 @@
+package maatq
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// 批量写入总是失败的内存后端
+type failingBatchBackend struct {
+	*MemoryBackend
+}
+
+func (b *failingBatchBackend) PushBatch(entries []QueueEntry) error {
+	return errors.New("connection refused")
+}
+
+// 批量写入时等待测试继续的内存后端
+type blockingBatchBackend struct {
+	*MemoryBackend
+	started chan struct{}
+	resume  chan struct{}
+}
+
+func (b *blockingBatchBackend) PushBatch(entries []QueueEntry) error {
+	b.started <- struct{}{}
+	<-b.resume
+	for _, e := range entries {
+		if err := b.MemoryBackend.Push(e.Queue, e.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSchedulerDispatchAllDue(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := NewScheduler(backend)
+	n := 2*dispatchBatchSize + 1
+	for i := 0; i < n; i++ {
+		s.Delay(&Message{Id: fmt.Sprintf("ID(%d)", i), Event: "hello"}, -time.Second)
+	}
+	p, _ := NewPeriod(60)
+	s.schedule(&PriorityMessage{Message: Message{Id: "ID(p)", Event: "hello"}, T: time.Now().Unix() - 10, P: p})
+	s.Delay(&Message{Id: "ID(later)", Event: "hello"}, time.Hour)
+
+	if _, err := s.tick(); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := backend.Len(DefaultQueue); l != int64(n+1) {
+		t.Error("一次 tick 应该执行所有到期的任务: ", l)
+	}
+	if s.heap.Len() != 2 || s.heap.find("ID(p)") < 0 {
+		t.Error("周期任务应该重新放回堆中: ", s.heap.Len())
+	}
+
+	m := s.Metrics()
+	if m.Dispatched != int64(n+1) || m.LastBatch != n+1 || m.LastLagMs < 9000 {
+		t.Error("执行任务的统计错误: ", m)
+	}
+}
+
+func TestSchedulerDispatchFailure(t *testing.T) {
+	s := NewScheduler(&failingBatchBackend{NewMemoryBackend()})
+	s.Delay(&Message{Id: "ID(1)", Event: "hello"}, -time.Second)
+	s.Delay(&Message{Id: "ID(2)", Event: "hello"}, -time.Second)
+
+	d, err := s.tick()
+	if err == nil || d != dispatchRetryInterval {
+		t.Error("写入失败时应该返回错误: ", d, err)
+	}
+	if s.heap.Len() != 2 {
+		t.Error("写入失败的任务应该放回堆中: ", s.heap.Len())
+	}
+	if m := s.Metrics(); m.Errors != 1 || m.Dispatched != 0 {
+		t.Error("执行任务的统计错误: ", m)
+	}
+}
+
+func TestSchedulerDispatchInflight(t *testing.T) {
+	backend := &blockingBatchBackend{NewMemoryBackend(), make(chan struct{}), make(chan struct{})}
+	s := NewScheduler(backend)
+	journal := NewBackendJournal(backend.MemoryBackend)
+	s.SetJournal(journal, 0)
+	p, _ := NewPeriod(60)
+	for _, id := range []string{"ID(1)", "ID(2)", "ID(3)"} {
+		s.schedule(&PriorityMessage{Message: Message{Id: id, Event: "hello"}, T: time.Now().Unix() - 10, P: p})
+	}
+	s.Delay(&Message{Id: "ID(4)", Event: "hello"}, -time.Second)
+	journal.Truncate()
+
+	done := make(chan error)
+	go func() {
+		_, err := s.dispatchDue(time.Now())
+		done <- err
+	}()
+	<-backend.started
+	if _, ok := s.Get("ID(1)"); !ok {
+		t.Error("写入期间应该可以查找任务")
+	}
+	if !s.Cancel("ID(1)") {
+		t.Error("写入期间应该可以取消任务")
+	}
+	if _, err := s.Register("ID(2)", &Message{Event: "world"}, p); err != nil {
+		t.Error("写入期间应该可以修改任务: ", err)
+	}
+	if _, err := s.Update("ID(4)", &ScheduleUpdate{Queue: "sms"}); err != ErrAlreadyDispatched {
+		t.Error("正在写入的一次性任务不能修改: ", err)
+	}
+	close(backend.resume)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.tick(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("ID(4)"); ok {
+		t.Error("一次性任务执行后不应该放回堆中")
+	}
+	if l, _ := backend.Len(tenantQueueName("", "sms")); l != 0 {
+		t.Error("一次性任务不应该执行两次: ", l)
+	}
+
+	if l, _ := backend.Len(DefaultQueue); l != 4 {
+		t.Error("所有到期的任务都应该写入工作队列: ", l)
+	}
+	if _, ok := s.Get("ID(1)"); ok {
+		t.Error("写入期间取消的任务不应该放回堆中")
+	}
+	pm, ok := s.Get("ID(2)")
+	if !ok || pm.Event != "world" || pm.T <= time.Now().Unix() || s.heap.Len() != 2 || len(s.inflight) != 0 {
+		t.Error("写入期间修改的任务应该保留修改后的任务，并且不重复执行: ", pm, s.heap.Len())
+	}
+
+	// 取消、注册和整批执行各一项日志
+	var entries []*JournalEntry
+	journal.Replay(func(e *JournalEntry) {
+		entries = append(entries, e)
+	})
+	if len(entries) != 3 || entries[2].Op != JournalBatch || len(entries[2].Batch) != 2 {
+		t.Fatal("整批执行应该只追加一项日志: ", len(entries))
+	}
+	h := newHeap()
+	for _, id := range []string{"ID(2)", "ID(3)", "ID(4)"} {
+		h.upsert(&PriorityMessage{Message: Message{Id: id}, P: p})
+	}
+	for _, e := range entries[1:] {
+		if err := e.apply(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pm, ok := h.get("ID(2)"); h.Len() != 2 || !ok || pm.Event != "world" {
+		t.Error("重放日志的结果错误: ", h)
+	}
+}
+
+func TestSchedulerStoreDispatchAllDue(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := NewScheduler(backend)
+	s.SetStore(NewScheduleStore(backend))
+	n := 2*scheduleDispatchLimit + 1
+	for i := 0; i < n; i++ {
+		s.Delay(&Message{Id: fmt.Sprintf("ID(%d)", i), Event: "hello"}, -time.Second)
+	}
+
+	if _, err := s.tick(); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := backend.Len(DefaultQueue); l != int64(n) {
+		t.Error("一次 tick 应该执行所有到期的任务: ", l)
+	}
+	if m := s.Metrics(); m.Dispatched != int64(n) || m.LastLagMs < 1000 {
+		t.Error("执行任务的统计错误: ", m)
+	}
+}
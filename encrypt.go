@@ -0,0 +1,141 @@
+package maatq
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// 消息体加密，使用 AES-GCM，消息中记录加密使用的密钥编号
+
+const (
+	encryptionName = "aes-gcm"
+)
+
+var (
+	ErrNoPrimaryKey  = errors.New("keyring has no primary key")
+	ErrCiphertext    = errors.New("ciphertext too short")
+	ErrInvalidKeyLen = errors.New("key length should be 16, 24 or 32 bytes")
+)
+
+// Keyring 保存多个密钥，使用主密钥加密，所有密钥都可以用来解密
+// 轮换密钥时先在所有 Worker 上添加新密钥，再在生产者上把新密钥设为主密钥，
+// 旧密钥加密的消息全部处理完后再移除旧密钥
+type Keyring struct {
+	mu      sync.RWMutex
+	primary string
+	keys    map[string][]byte
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys: make(map[string][]byte),
+	}
+}
+
+// Add 添加密钥，第一个添加的密钥会成为主密钥
+func (k *Keyring) Add(id string, key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return ErrInvalidKeyLen
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = key
+	if len(k.primary) == 0 {
+		k.primary = id
+	}
+	return nil
+}
+
+// SetPrimary 设置用于加密的主密钥
+func (k *Keyring) SetPrimary(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("key not found: %s", id)
+	}
+	k.primary = id
+	return nil
+}
+
+// Remove 移除密钥，不能移除主密钥
+func (k *Keyring) Remove(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id == k.primary {
+		return errors.New("can not remove primary key")
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+// Ids 返回所有密钥的编号
+func (k *Keyring) Ids() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (k *Keyring) get(id string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key not found: %s", id)
+	}
+	return key, nil
+}
+
+func (k *Keyring) primaryKey() (string, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.primary) == 0 {
+		return "", nil, ErrNoPrimaryKey
+	}
+	return k.primary, k.keys[k.primary], nil
+}
+
+// 加密数据，返回 nonce 和密文拼接的结果，ad 为附加的认证数据
+func encrypt(key, plaintext, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func decrypt(key, ciphertext, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrCiphertext
+	}
+	n := gcm.NonceSize()
+	return gcm.Open(nil, ciphertext[:n], ciphertext[n:], ad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
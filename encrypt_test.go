@@ -0,0 +1,74 @@
+package maatq
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	k := NewKeyring()
+	if err := k.Add("k1", []byte("short")); err != ErrInvalidKeyLen {
+		t.Error("密钥长度错误应该返回错误")
+	}
+	k.Add("k1", bytes.Repeat([]byte{1}, 32))
+	k.Add("k2", bytes.Repeat([]byte{2}, 16))
+
+	if id, _, _ := k.primaryKey(); id != "k1" {
+		t.Error("第一个密钥应该是主密钥: ", id)
+	}
+	if err := k.SetPrimary("k3"); err == nil {
+		t.Error("不存在的密钥不能设为主密钥")
+	}
+	k.SetPrimary("k2")
+	if err := k.Remove("k2"); err == nil {
+		t.Error("不能移除主密钥")
+	}
+	if !reflect.DeepEqual(k.Ids(), []string{"k1", "k2"}) {
+		t.Error("密钥列表错误: ", k.Ids())
+	}
+}
+
+func TestPayloadEncrypt(t *testing.T) {
+	producer := NewKeyring()
+	producer.Add("k1", bytes.Repeat([]byte{1}, 32))
+	p := newPayloadPipeline(nil, 0)
+	p.setKeyring(producer)
+
+	c, _ := GetCompressor("gzip")
+	p.setCompressor(c, 16)
+
+	data := map[string]interface{}{"phone": "13800000000", "email": strings.Repeat("a", 32) + "@example.com"}
+	m := &Message{Id: "ID(1)", Event: "hello", Data: data}
+	if err := p.encode(m, false); err != nil {
+		t.Fatal(err)
+	}
+	if m.Encoding != "gzip,aes-gcm" || m.KeyId != "k1" {
+		t.Error("消息应该被压缩并加密: ", m.Encoding, m.KeyId)
+	}
+
+	// 轮换密钥后仍然可以解密旧消息
+	consumer := NewKeyring()
+	consumer.Add("k2", bytes.Repeat([]byte{2}, 32))
+	consumer.Add("k1", bytes.Repeat([]byte{1}, 32))
+	w := newPayloadPipeline(nil, 0)
+	w.setKeyring(consumer)
+
+	tampered := *m
+	tampered.Id = "ID(2)"
+	if err := w.decode(&tampered); err == nil {
+		t.Error("消息编号被修改后应该解密失败")
+	}
+
+	if err := w.decode(m); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Data, data) {
+		t.Error("解密后的数据错误: ", m.Data)
+	}
+
+	if err := newPayloadPipeline(nil, 0).decode(&tampered); err != ErrNoKeyring {
+		t.Error("没有密钥时应该返回错误: ", err)
+	}
+}
@@ -2,6 +2,7 @@ package maatq
 
 import (
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
@@ -40,6 +41,7 @@ func NewCheckItem(n string, d time.Duration, c string) *checkItem {
 
 // healthChecker 健康度检查器
 type healthChecker struct {
+	mu       sync.RWMutex
 	items    map[string]*checkItem
 	interval time.Duration
 }
@@ -59,6 +61,8 @@ func NewHealthChecker(i time.Duration) *healthChecker {
 //     - name: 检查项名称
 //     - d: 超时死亡时间
 func (c *healthChecker) AddItem(i *checkItem) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	_, ok := c.items[i.name]
 	if ok {
 		return errHealthCheckItemExists
@@ -69,7 +73,7 @@ func (c *healthChecker) AddItem(i *checkItem) error {
 
 func (c *healthChecker) ServeLoop() error {
 	for {
-		for _, i := range c.items {
+		for _, i := range c.snapshot() {
 			if i.isTimeout() && i.isAlive() {
 				i.dead()
 			}
@@ -78,6 +82,20 @@ func (c *healthChecker) ServeLoop() error {
 	}
 }
 
+// 返回所有检查项的副本，按名称排序
+func (c *healthChecker) snapshot() []*checkItem {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	items := make([]*checkItem, 0, len(c.items))
+	for _, i := range c.items {
+		items = append(items, i)
+	}
+	sort.Slice(items, func(a, b int) bool {
+		return items[a].name < items[b].name
+	})
+	return items
+}
+
 func (c *checkItem) isTimeout() bool {
 	return time.Unix(c.timestamp, 0).Add(c.deadline).Before(time.Now())
 }
@@ -1,6 +1,7 @@
 package maatq
 
 import (
+	"fmt"
 	"testing"
 	"time"
 )
@@ -44,3 +45,22 @@ func TestHealthChecker(t *testing.T) {
 	})
 	c.AddItem(i)
 }
+
+func TestHealthCheckerSnapshot(t *testing.T) {
+	c := NewHealthChecker(time.Second)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.snapshot()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		c.AddItem(NewCheckItem(fmt.Sprintf("item%03d", i), time.Minute, ""))
+	}
+	<-done
+	items := c.snapshot()
+	if len(items) != 100 || items[0].name != "item000" || items[99].name != "item099" {
+		t.Error("检查项错误: ", len(items))
+	}
+}
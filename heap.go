@@ -8,8 +8,10 @@ import (
 
 // minHeap to hold peroidic messages, minHeap implements
 // container/heap.Interface
+// 同时维护任务编号到下标的索引，按编号查找、取消和更新任务的复杂度为 O(log n)
 type minHeap struct {
 	Items *[]*PriorityMessage
+	index map[string]int
 }
 
 func (h minHeap) String() string {
@@ -27,30 +29,96 @@ func (h minHeap) Len() int {
 	return len(*h.Items)
 }
 
+// 暂停的任务排在所有任务的后面
 func (h minHeap) Less(i, j int) bool {
-	return (*h.Items)[i].T < (*h.Items)[j].T
+	a, b := (*h.Items)[i], (*h.Items)[j]
+	if a.Paused != b.Paused {
+		return b.Paused
+	}
+	return a.T < b.T
 }
 
 func (h minHeap) Swap(i, j int) {
 	(*h.Items)[i], (*h.Items)[j] = (*h.Items)[j], (*h.Items)[i]
+	h.index[(*h.Items)[i].Id] = i
+	h.index[(*h.Items)[j].Id] = j
 }
 
 func (h minHeap) Push(x interface{}) {
-	*h.Items = append(*h.Items, x.(*PriorityMessage))
+	pm := x.(*PriorityMessage)
+	h.index[pm.Id] = len(*h.Items)
+	*h.Items = append(*h.Items, pm)
 }
 
 func (h minHeap) Pop() interface{} {
 	n := len(*h.Items) - 1
 	v := (*h.Items)[n]
 	*h.Items = (*h.Items)[0:n]
+	if i, ok := h.index[v.Id]; ok && i == n {
+		delete(h.index, v.Id)
+	}
 	return v
 }
 
+// 查找任务的下标，没有找到时返回-1
+func (h minHeap) find(id string) int {
+	if i, ok := h.index[id]; ok {
+		return i
+	}
+	return -1
+}
+
+// 按编号查找任务
+func (h minHeap) get(id string) (*PriorityMessage, bool) {
+	i := h.find(id)
+	if i < 0 {
+		return nil, false
+	}
+	return (*h.Items)[i], true
+}
+
+// 添加任务，编号相同的任务已经存在时替换
+func (h *minHeap) upsert(pm *PriorityMessage) {
+	if i := h.find(pm.Id); i >= 0 {
+		(*h.Items)[i] = pm
+		heap.Fix(h, i)
+		return
+	}
+	heap.Push(h, pm)
+}
+
+// 按编号删除任务
+func (h *minHeap) remove(id string) (*PriorityMessage, bool) {
+	i := h.find(id)
+	if i < 0 {
+		return nil, false
+	}
+	return heap.Remove(h, i).(*PriorityMessage), true
+}
+
+// 重建索引，用于读取旧版本 gob 编码的快照，编号重复时只保留最后一个
+func (h *minHeap) reindex() {
+	h.index = make(map[string]int, h.Len())
+	items := make([]*PriorityMessage, 0, h.Len())
+	for i := 0; i < h.Len(); i++ {
+		pm := (*h.Items)[i]
+		if j, ok := h.index[pm.Id]; ok {
+			items[j] = pm
+			continue
+		}
+		h.index[pm.Id] = len(items)
+		items = append(items, pm)
+	}
+	*h.Items = items
+	heap.Init(h)
+}
+
 // newHeap get a pointer of minHeap
 func newHeap() *minHeap {
 	s := make([]*PriorityMessage, 0)
 	h := &minHeap{
 		Items: &s,
+		index: make(map[string]int),
 	}
 	heap.Init(h)
 
@@ -2,6 +2,7 @@ package maatq
 
 import (
 	"container/heap"
+	"fmt"
 	"testing"
 )
 
@@ -26,3 +27,31 @@ func TestHeap(t *testing.T) {
 		}
 	}
 }
+
+func TestHeapIndex(t *testing.T) {
+	h := newHeap()
+	for i := 10; i > 0; i-- {
+		heap.Push(h, &PriorityMessage{Message: Message{Id: fmt.Sprintf("ID(%d)", i)}, T: int64(i)})
+	}
+	if pm, ok := h.get("ID(5)"); !ok || pm.T != 5 {
+		t.Error("按编号查找任务错误: ", pm)
+	}
+	if _, ok := h.remove("ID(1)"); !ok {
+		t.Error("删除任务错误")
+	}
+	h.upsert(&PriorityMessage{Message: Message{Id: "ID(5)"}, T: 0})
+	if h.Len() != 9 || (*h.Items)[0].Id != "ID(5)" {
+		t.Error("替换任务后应该调整位置: ", h)
+	}
+	for h.Len() > 0 {
+		pm := heap.Pop(h).(*PriorityMessage)
+		if h.find(pm.Id) >= 0 {
+			t.Error("取出的任务应该从索引中删除: ", pm.Id)
+		}
+		for i, v := range *h.Items {
+			if h.find(v.Id) != i {
+				t.Fatal("索引和下标不一致: ", v.Id)
+			}
+		}
+	}
+}
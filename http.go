@@ -1,10 +1,33 @@
 package maatq
 
+import (
+	"encoding/json"
+	"net/http"
+)
+
 type response struct {
-	Ok      bool   `json:"ok"`
-	Code    int    `json:"code"`
-	EventId string `json:"event_id"`
-	Err     string `json:"err"`
+	Ok      bool         `json:"ok"`
+	Code    int          `json:"code"`
+	EventId string       `json:"event_id"`
+	Err     string       `json:"err"`
+	Errors  []FieldError `json:"errors,omitempty"`
+}
+
+// 写入消息失败时的应答，数据校验失败时返回400和字段错误
+func newWriteErrorResponse(err error) (int, response) {
+	if v, ok := err.(*ValidationError); ok {
+		return http.StatusBadRequest, response{
+			Ok:     false,
+			Err:    err.Error(),
+			Code:   109,
+			Errors: v.Errors,
+		}
+	}
+	return http.StatusInternalServerError, response{
+		Ok:   false,
+		Err:  err.Error(),
+		Code: 101,
+	}
 }
 
 type delayRequest struct {
@@ -12,6 +35,8 @@ type delayRequest struct {
 	Data  interface{} `json:"data"`
 	Delay string      `json:"delay"`
 	Queue string      `json:"queue"`
+	Tags  []string    `json:"tags"`
+	Name  string      `json:"name"`
 }
 
 type periodRequest struct {
@@ -19,11 +44,28 @@ type periodRequest struct {
 	Data   interface{} `json:"data"`
 	Period int64       `json:"period"`
 	Queue  string      `json:"queue"`
+	Tags   []string    `json:"tags"`
+	Name   string      `json:"name"`
+}
+
+// 修改任务，at 为 Unix 时间，为空的字段保持不变
+type scheduleUpdateRequest struct {
+	At       int64           `json:"at"`
+	Delay    string          `json:"delay"`
+	Period   int64           `json:"period"`
+	Crontab  string          `json:"crontab"`
+	Timezone string          `json:"timezone"`
+	Once     bool            `json:"once"`
+	Data     json.RawMessage `json:"data"`
+	Queue    string          `json:"queue"`
 }
 
 type crontabRequest struct {
-	Event   string      `json:"event"`
-	Data    interface{} `json:"data"`
-	Crontab string      `json:"crontab"`
-	Queue   string      `json:"queue"`
+	Event    string      `json:"event"`
+	Data     interface{} `json:"data"`
+	Crontab  string      `json:"crontab"`
+	Timezone string      `json:"timezone"`
+	Queue    string      `json:"queue"`
+	Tags     []string    `json:"tags"`
+	Name     string      `json:"name"`
 }
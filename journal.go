@@ -0,0 +1,237 @@
+package maatq
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// 调度器的预写日志，内存中的任务每次变化都先追加到日志，
+// 定时保存快照后清空日志，启动时从快照和日志恢复任务
+
+const (
+	MAATQ_JOURNAL_KEY = "maatq:scheduler:journal"
+
+	DefaultSnapshotInterval = time.Minute
+)
+
+const (
+	JournalAdd      = "add"
+	JournalCancel   = "cancel"
+	JournalDispatch = "dispatch"
+	JournalBatch    = "batch"
+)
+
+// JournalEntry 日志中的一项，使用 JSON 编码
+type JournalEntry struct {
+	Op    string          `json:"op"`
+	Entry *ScheduleEntry  `json:"entry,omitempty"` // JournalAdd 时的任务
+	Id    string          `json:"id,omitempty"`    // JournalCancel 和 JournalDispatch 时的任务编号
+	T     int64           `json:"t,omitempty"`     // JournalDispatch 时周期任务下一次执行的时间，为0时任务被删除
+	Batch []*JournalEntry `json:"batch,omitempty"` // JournalBatch 时按顺序执行的多项日志
+}
+
+// Journal 保存日志的存储
+type Journal interface {
+	Append(e *JournalEntry) error
+	// Replay 按顺序读取所有日志
+	Replay(f func(e *JournalEntry)) error
+	// Truncate 保存快照后清空日志
+	Truncate() error
+}
+
+func encodeJournalEntry(e *JournalEntry) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func decodeJournalEntry(b []byte) (*JournalEntry, error) {
+	var e JournalEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// 在堆上重放一项日志，重放是幂等的，快照之后没来得及清空的日志可以再次重放
+func (e *JournalEntry) apply(h *minHeap) error {
+	switch e.Op {
+	case JournalAdd:
+		pm, err := e.Entry.priorityMessage()
+		if err != nil {
+			return err
+		}
+		h.upsert(pm)
+	case JournalCancel:
+		h.remove(e.Id)
+	case JournalDispatch:
+		i := h.find(e.Id)
+		if i < 0 {
+			return nil
+		}
+		if e.T == 0 {
+			heap.Remove(h, i)
+		} else {
+			(*h.Items)[i].T = e.T
+			heap.Fix(h, i)
+		}
+	case JournalBatch:
+		for _, b := range e.Batch {
+			if err := b.apply(h); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BackendJournal 把日志保存在存储后端的列表中，多个调度器选举时可以共享
+type BackendJournal struct {
+	backend Backend
+}
+
+func NewBackendJournal(backend Backend) *BackendJournal {
+	return &BackendJournal{backend: backend}
+}
+
+func (j *BackendJournal) Append(e *JournalEntry) error {
+	b, err := encodeJournalEntry(e)
+	if err != nil {
+		return err
+	}
+	return j.backend.Push(MAATQ_JOURNAL_KEY, b)
+}
+
+func (j *BackendJournal) Replay(f func(e *JournalEntry)) error {
+	values, err := j.backend.Range(MAATQ_JOURNAL_KEY, 0, -1)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		e, err := decodeJournalEntry(v)
+		if err != nil {
+			return err
+		}
+		f(e)
+	}
+	return nil
+}
+
+func (j *BackendJournal) Truncate() error {
+	return j.backend.Del(MAATQ_JOURNAL_KEY)
+}
+
+// FileJournal 把日志保存在本地文件中，每一项前面是 varint 编码的长度
+type FileJournal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func NewFileJournal(path string) (*FileJournal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileJournal{path: path, f: f}, nil
+}
+
+func (j *FileJournal) Append(e *JournalEntry) error {
+	b, err := encodeJournalEntry(e)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(b))
+	buf = append(buf[:binary.PutUvarint(buf, uint64(len(b)))], b...)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(buf); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// Replay 进程崩溃时最后一项可能不完整，忽略不完整的项
+func (j *FileJournal) Replay(f func(e *JournalEntry)) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	file, err := os.Open(j.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		e, err := decodeJournalEntry(b)
+		if err != nil {
+			return err
+		}
+		f(e)
+	}
+}
+
+func (j *FileJournal) Truncate() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Truncate(0)
+}
+
+func (j *FileJournal) Close() error {
+	return j.f.Close()
+}
+
+// SetJournal 开启预写日志，interval 为保存快照的间隔，为0时使用 DefaultSnapshotInterval
+func (s *Scheduler) SetJournal(j Journal, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultSnapshotInterval
+	}
+	s.journal = j
+	s.snapshotInterval = interval
+}
+
+// 追加日志，调用时需要持有 s.mu
+func (s *Scheduler) appendJournal(e *JournalEntry) {
+	if s.journal == nil {
+		return
+	}
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+	s.writeJournal(e)
+}
+
+// 写入日志，调用时需要持有 s.journalMu
+func (s *Scheduler) writeJournal(e *JournalEntry) {
+	if err := s.journal.Append(e); err != nil {
+		s.logger.WithError(err).Errorf("Append journal %s error", e.Op)
+	}
+}
+
+// 定时保存快照并清空日志
+func (s *Scheduler) snapshot() {
+	if s.journal == nil || time.Since(s.lastSyncTime) < s.snapshotInterval {
+		return
+	}
+	if err := s.dumps(); err != nil {
+		s.logger.WithError(err).Error("Snapshot error")
+	}
+}
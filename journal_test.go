@@ -0,0 +1,78 @@
+package maatq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testJournalRecovery(t *testing.T, backend Backend, journal Journal) {
+	s := NewScheduler(backend)
+	s.SetJournal(journal, time.Hour)
+
+	s.Delay(&Message{Id: "ID(1)", Event: "hello"}, -time.Second)
+	s.Delay(&Message{Id: "ID(2)", Event: "hello"}, time.Hour)
+	s.Delay(&Message{Id: "ID(3)", Event: "hello"}, time.Hour)
+	p, _ := NewPeriod(60)
+	s.Period(&Message{Id: "ID(4)", Event: "hello"}, p)
+	s.Cancel("ID(3)")
+	if _, err := s.tick(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟进程崩溃，没有保存快照
+	recovered := NewScheduler(backend)
+	recovered.SetJournal(journal, time.Hour)
+	h, err := recovered.loads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Len() != 2 || h.find("ID(1)") >= 0 || h.find("ID(3)") >= 0 || h.find("ID(4)") < 0 {
+		t.Error("从日志恢复的任务错误: ", h)
+	}
+
+	// 保存快照后清空日志
+	if err := s.dumps(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	journal.Replay(func(e *JournalEntry) { n++ })
+	if n != 0 {
+		t.Error("保存快照后应该清空日志: ", n)
+	}
+	s.Delay(&Message{Id: "ID(5)", Event: "hello"}, time.Hour)
+	if h, _ = recovered.loads(); h.Len() != 3 || h.find("ID(5)") < 0 {
+		t.Error("从快照和日志恢复的任务错误: ", h)
+	}
+}
+
+func TestBackendJournal(t *testing.T) {
+	backend := NewMemoryBackend()
+	testJournalRecovery(t, backend, NewBackendJournal(backend))
+}
+
+func TestFileJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maatq-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+	j, err := NewFileJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	testJournalRecovery(t, NewMemoryBackend(), j)
+
+	// 忽略最后一项不完整的日志
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{100, 1, 2})
+	f.Close()
+	n := 0
+	if err := j.Replay(func(e *JournalEntry) { n++ }); err != nil || n != 1 {
+		t.Error("读取日志错误: ", n, err)
+	}
+}
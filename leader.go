@@ -0,0 +1,175 @@
+package maatq
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 调度器的高可用，多个调度器通过存储后端中的租约选举出一个 leader，
+// 只有 leader 执行到期的任务，其他调度器收到的任务通过收件箱转交给 leader。
+// leader 定时把任务保存到共享存储，租约过期后其他调度器接管并从共享存储恢复任务
+
+const (
+	MAATQ_SCHEDULER_LEADER_KEY = "maatq:scheduler:leader"
+	MAATQ_SCHEDULER_INBOX_KEY  = "maatq:scheduler:inbox"
+
+	DefaultSchedulerLeaseTTL = 15 * time.Second
+
+	// leader 保存任务的最小间隔，故障转移时这段时间内执行的任务可能被重复执行
+	schedulerSyncInterval = time.Second
+)
+
+// EnableLeaderElection 开启选举，ttl 为租约的有效期，为0时使用 DefaultSchedulerLeaseTTL
+func (s *Scheduler) EnableLeaderElection(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = DefaultSchedulerLeaseTTL
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ha = true
+	s.leaseTTL = ttl
+	s.owner = fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), uuid.New().String())
+}
+
+// OnElected 设置成为 leader 并恢复任务后调用的函数
+func (s *Scheduler) OnElected(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onElected = f
+}
+
+// IsLeader 没有开启选举时总是返回 true
+func (s *Scheduler) IsLeader() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.ha || s.leader
+}
+
+// 续约或者竞选，每 leaseTTL/3 最多执行一次
+func (s *Scheduler) elect() {
+	if time.Since(s.renewedAt) < s.leaseTTL/3 {
+		return
+	}
+	s.renewedAt = time.Now()
+
+	ok, err := s.backend.Lease(MAATQ_SCHEDULER_LEADER_KEY, s.owner, s.leaseTTL)
+	if err != nil {
+		// 无法续约时租约可能已经过期，放弃执行任务
+		s.logger.WithError(err).Error("Lease error")
+		ok = false
+	}
+
+	s.mu.Lock()
+	was := s.leader
+	s.leader = ok
+	s.mu.Unlock()
+
+	switch {
+	case ok && !was:
+		s.logger.Info("Elected as leader")
+		s.takeover()
+		s.mu.Lock()
+		f := s.onElected
+		s.mu.Unlock()
+		if f != nil {
+			go f()
+		}
+	case !ok && was:
+		s.logger.Warn("Lost leadership")
+	}
+}
+
+// 成为 leader 后从共享存储恢复任务
+func (s *Scheduler) takeover() {
+	if s.store != nil {
+		return
+	}
+	h, err := s.loads()
+	if err == ErrNil {
+		return
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("Load dumps error")
+		return
+	}
+	s.mu.Lock()
+	s.heap = h
+	// 共享存储中的任务是最新的，之前正在写入的任务写入后不再放回堆中
+	s.inflight = make(map[string]*PriorityMessage)
+	s.mu.Unlock()
+	s.logger.Infof("%d messages taken over", h.Len())
+}
+
+// 处理其他调度器转交的操作，只由 leader 调用
+func (s *Scheduler) receiveCommands() {
+	n, err := s.backend.Len(MAATQ_SCHEDULER_INBOX_KEY)
+	if err != nil {
+		s.logger.WithError(err).Error("Read inbox error")
+		return
+	}
+	for ; n > 0; n-- {
+		_, b, err := s.backend.Pop(drainPollTimeout, MAATQ_SCHEDULER_INBOX_KEY)
+		if err != nil {
+			if err != ErrNil {
+				s.logger.WithError(err).Error("Read inbox error")
+			}
+			return
+		}
+		e, err := decodeJournalEntry(b)
+		if err != nil {
+			s.logger.WithError(err).Error("Decode scheduler command error")
+			continue
+		}
+		switch e.Op {
+		case JournalAdd:
+			pm, err := e.Entry.priorityMessage()
+			if err != nil {
+				s.logger.WithError(err).Error("Decode scheduler command error")
+				continue
+			}
+			s.schedule(pm)
+		case JournalCancel:
+			s.Cancel(e.Id)
+		}
+	}
+}
+
+// 把操作转交给 leader，格式和预写日志相同
+func (s *Scheduler) send(e *JournalEntry) error {
+	b, err := encodeJournalEntry(e)
+	if err != nil {
+		return err
+	}
+	return s.backend.Push(MAATQ_SCHEDULER_INBOX_KEY, b)
+}
+
+// 任务有变化时保存到共享存储，两次保存之间至少间隔 schedulerSyncInterval
+// 开启预写日志时变化已经写入日志，不需要额外保存
+func (s *Scheduler) sync() {
+	if s.journal != nil {
+		return
+	}
+	s.mu.Lock()
+	due := s.dirty && time.Since(s.lastSyncTime) >= schedulerSyncInterval
+	s.mu.Unlock()
+	if !due {
+		return
+	}
+	if err := s.dumps(); err != nil {
+		s.logger.WithError(err).Error("Dumps error")
+	}
+}
+
+// 释放租约，让其他调度器尽快接管
+func (s *Scheduler) resign() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ha || !s.leader {
+		return nil
+	}
+	s.leader = false
+	return s.backend.Release(MAATQ_SCHEDULER_LEADER_KEY, s.owner)
+}
@@ -0,0 +1,88 @@
+package maatq
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLeaderScheduler(backend Backend) *Scheduler {
+	s := NewScheduler(backend)
+	s.EnableLeaderElection(time.Minute)
+	return s
+}
+
+func TestMemoryBackendLease(t *testing.T) {
+	b := NewMemoryBackend()
+	if ok, _ := b.Lease("lease", "a", time.Minute); !ok {
+		t.Error("租约不存在时应该成功")
+	}
+	if ok, _ := b.Lease("lease", "b", time.Minute); ok {
+		t.Error("租约被其他人持有时应该失败")
+	}
+	if ok, _ := b.Lease("lease", "a", time.Minute); !ok {
+		t.Error("持有者应该可以续约")
+	}
+	b.Release("lease", "b")
+	if ok, _ := b.Lease("lease", "b", time.Minute); ok {
+		t.Error("只有持有者可以释放租约")
+	}
+	b.Release("lease", "a")
+	if ok, _ := b.Lease("lease", "b", time.Millisecond); !ok {
+		t.Error("租约释放后应该可以获得")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if ok, _ := b.Lease("lease", "a", time.Minute); !ok {
+		t.Error("租约过期后应该可以获得")
+	}
+}
+
+func TestSchedulerLeaderElection(t *testing.T) {
+	backend := NewMemoryBackend()
+	s1 := newTestLeaderScheduler(backend)
+	s2 := newTestLeaderScheduler(backend)
+
+	s1.elect()
+	s2.elect()
+	if !s1.IsLeader() || s2.IsLeader() {
+		t.Fatal("只能有一个 leader")
+	}
+
+	// 非 leader 收到的任务转交给 leader 执行
+	s2.Delay(&Message{Id: "ID(1)", Event: "hello"}, -time.Second)
+	if s2.heap.Len() != 0 {
+		t.Error("非 leader 不应该保存任务")
+	}
+	s1.receiveCommands()
+	if _, err := s1.tick(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := backend.Len(DefaultQueue); n != 1 {
+		t.Error("leader 应该执行转交的任务: ", n)
+	}
+
+	p, _ := NewPeriod(60)
+	s1.Period(&Message{Id: "ID(2)", Event: "hello"}, p)
+	s1.sync()
+	if s2.Cancel("ID(3)") {
+		t.Error("不存在的任务不能取消")
+	}
+
+	// leader 退出后其他调度器接管任务
+	if err := s1.resign(); err != nil {
+		t.Fatal(err)
+	}
+	s2.renewedAt = time.Time{}
+	s2.elect()
+	if !s2.IsLeader() {
+		t.Fatal("租约释放后应该成为 leader")
+	}
+	if s2.heap.find("ID(2)") < 0 {
+		t.Error("接管后应该恢复 leader 保存的任务")
+	}
+	if s1.dumps(); s1.IsLeader() {
+		t.Error("退出后不应该是 leader")
+	}
+	if !s2.Cancel("ID(2)") {
+		t.Error("leader 应该可以取消任务")
+	}
+}
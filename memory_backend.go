@@ -0,0 +1,279 @@
+package maatq
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryBackend 内存中的存储后端，用于单元测试，不支持多个进程共享
+type MemoryBackend struct {
+	mu      sync.Mutex
+	lists   map[string][][]byte
+	values  map[string]memoryValue
+	sets    map[string]map[string]bool
+	zsets   map[string]map[string]float64
+	changed chan struct{}
+}
+
+type memoryValue struct {
+	data     []byte
+	expireAt time.Time
+}
+
+func (v memoryValue) expired() bool {
+	return !v.expireAt.IsZero() && time.Now().After(v.expireAt)
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		lists:   make(map[string][][]byte),
+		values:  make(map[string]memoryValue),
+		sets:    make(map[string]map[string]bool),
+		zsets:   make(map[string]map[string]float64),
+		changed: make(chan struct{}),
+	}
+}
+
+func (b *MemoryBackend) Ping() error {
+	return nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
+
+// 唤醒等待队列的 Pop，调用时需要持有锁
+func (b *MemoryBackend) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *MemoryBackend) Push(queue string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lists[queue] = append(b.lists[queue], data)
+	b.notify()
+	return nil
+}
+
+func (b *MemoryBackend) PushFront(queue string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lists[queue] = append([][]byte{data}, b.lists[queue]...)
+	b.notify()
+	return nil
+}
+
+func (b *MemoryBackend) PushBatch(entries []QueueEntry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range entries {
+		b.lists[e.Queue] = append(b.lists[e.Queue], e.Data)
+	}
+	b.notify()
+	return nil
+}
+
+// Pop timeout 为0时一直等待
+func (b *MemoryBackend) Pop(timeout time.Duration, queues ...string) (string, []byte, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		b.mu.Lock()
+		for _, q := range queues {
+			if l := b.lists[q]; len(l) > 0 {
+				b.lists[q] = l[1:]
+				b.mu.Unlock()
+				return q, l[0], nil
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return "", nil, ErrNil
+		}
+	}
+}
+
+func (b *MemoryBackend) Len(queue string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(len(b.lists[queue])), nil
+}
+
+// Range 下标的含义和 LRANGE 相同，负数表示从尾部开始
+func (b *MemoryBackend) Range(queue string, start, stop int64) ([][]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l := b.lists[queue]
+	start, end, ok := clampRange(int64(len(l)), start, stop)
+	if !ok {
+		return [][]byte{}, nil
+	}
+	rv := make([][]byte, end-start)
+	copy(rv, l[start:end])
+	return rv, nil
+}
+
+func (b *MemoryBackend) get(key string) ([]byte, bool) {
+	v, ok := b.values[key]
+	if !ok {
+		return nil, false
+	}
+	if v.expired() {
+		delete(b.values, key)
+		return nil, false
+	}
+	return v.data, true
+}
+
+func (b *MemoryBackend) Get(key string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	v, ok := b.get(key)
+	if !ok {
+		return nil, ErrNil
+	}
+	return v, nil
+}
+
+func (b *MemoryBackend) MGet(keys ...string) ([][]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rv := make([][]byte, len(keys))
+	for i, key := range keys {
+		rv[i], _ = b.get(key)
+	}
+	return rv, nil
+}
+
+func (b *MemoryBackend) Set(key string, value []byte, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	v := memoryValue{data: value}
+	if ttl > 0 {
+		v.expireAt = time.Now().Add(ttl)
+	}
+	b.values[key] = v
+	return nil
+}
+
+func (b *MemoryBackend) Del(keys ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range keys {
+		delete(b.values, key)
+		delete(b.lists, key)
+		delete(b.sets, key)
+		delete(b.zsets, key)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) SAdd(key string, members ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.sets[key]; !ok {
+		b.sets[key] = make(map[string]bool)
+	}
+	for _, m := range members {
+		b.sets[key][m] = true
+	}
+	return nil
+}
+
+func (b *MemoryBackend) SRem(key string, members ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range members {
+		delete(b.sets[key], m)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) SMembers(key string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rv := make([]string, 0, len(b.sets[key]))
+	for m := range b.sets[key] {
+		rv = append(rv, m)
+	}
+	sort.Strings(rv)
+	return rv, nil
+}
+
+func (b *MemoryBackend) ZAdd(key string, score float64, member string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.zsets[key]; !ok {
+		b.zsets[key] = make(map[string]float64)
+	}
+	b.zsets[key][member] = score
+	return nil
+}
+
+func (b *MemoryBackend) ZRem(key string, members ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range members {
+		delete(b.zsets[key], m)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) ZRangeByScore(key string, min, max float64) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	z := b.zsets[key]
+	rv := make([]string, 0, len(z))
+	for m, score := range z {
+		if score >= min && score <= max {
+			rv = append(rv, m)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if z[rv[i]] == z[rv[j]] {
+			return rv[i] < rv[j]
+		}
+		return z[rv[i]] < z[rv[j]]
+	})
+	return rv, nil
+}
+
+func (b *MemoryBackend) ZRemRangeByScore(key string, min, max float64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for m, score := range b.zsets[key] {
+		if score >= min && score <= max {
+			delete(b.zsets[key], m)
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Lease(key, owner string, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if v, ok := b.get(key); ok && string(v) != owner {
+		return false, nil
+	}
+	b.values[key] = memoryValue{data: []byte(owner), expireAt: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (b *MemoryBackend) Release(key, owner string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if v, ok := b.get(key); ok && string(v) == owner {
+		delete(b.values, key)
+	}
+	return nil
+}
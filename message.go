@@ -1,7 +1,6 @@
 package maatq
 
 import (
-	"encoding/json"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -14,6 +13,26 @@ type Message struct {
 	Try       int         `json:"try"`
 	Data      interface{} `json:"data,omitempty"`
 	Queue     string      `json:"queue,omitempty"`
+
+	// 数据过大时保存在 BlobStore 中，这里只保留引用
+	DataRef    string `json:"data_ref,omitempty"`
+	DataPinned bool   `json:"data_pinned,omitempty"`
+	// 消息数据依次使用的编码，例如 gzip，不为空时数据是 base64 字符串
+	Encoding string `json:"encoding,omitempty"`
+	// 加密消息数据使用的密钥编号
+	KeyId string `json:"key_id,omitempty"`
+	// 消息签名
+	Producer  string `json:"producer,omitempty"`
+	SigKey    string `json:"sig_key,omitempty"`
+	Signature string `json:"sig,omitempty"`
+	// 消息在队列中的序列化格式，为空时是 JSON
+	ContentType string `json:"content_type,omitempty"`
+	// 消息数据的版本，为空时视为版本1
+	Version int `json:"version,omitempty"`
+	// 租户，不为空时消息写入租户自己的队列，结果和失败队列也相互隔离
+	Tenant string `json:"tenant,omitempty"`
+	// 标签，用于按标签批量取消任务
+	Tags []string `json:"tags,omitempty"`
 }
 
 func (m *Message) ToLogFields() log.Fields {
@@ -24,19 +43,30 @@ func (m *Message) ToLogFields() log.Fields {
 		"try":       m.Try,
 		"data":      m.Data,
 		"queue":     m.GetWorkQueue(),
+		"version":   m.Version,
+		"tenant":    m.Tenant,
 	}
 }
 
 func (m *Message) GetWorkQueue() string {
 	if len(m.Queue) == 0 {
-		return DefaultQueue
+		return tenantKey(m.Tenant, DefaultQueue)
 	}
-	return queueName(m.Queue)
+	return tenantQueueName(m.Tenant, m.Queue)
+}
+
+// Result 消息的处理结果，以消息编号为键保存
+type Result struct {
+	Success   bool        `json:"success"`
+	Error     string      `json:"error"`
+	Data      interface{} `json:"data"`
+	Timestamp int64       `json:"timestamp"`
 }
 
 // 处理中的消息的结构
 type handlingMessage struct {
 	Queue     string
+	AckId     string // 需要确认的消息编号，见 Acker
 	Msg       *Message
 	Error     error
 	Result    interface{}
@@ -44,18 +74,16 @@ type handlingMessage struct {
 	EndTime   time.Time
 }
 
-func newHandlingMessage(queue, msg string) (*handlingMessage, error) {
-	var (
-		m  Message
-		rv *handlingMessage
-	)
-	if err := json.Unmarshal([]byte(msg), &m); err != nil {
+func newHandlingMessage(queue string, msg []byte) (*handlingMessage, error) {
+	var rv *handlingMessage
+	m, err := unmarshalMessage(msg)
+	if err != nil {
 		return nil, err
 	}
 
 	rv = &handlingMessage{
 		Queue:     queue,
-		Msg:       &m,
+		Msg:       m,
 		StartTime: time.Now(),
 	}
 
@@ -0,0 +1,173 @@
+package maatq
+
+import (
+	"strings"
+	"time"
+)
+
+// 键的命名空间和租户
+// 命名空间作用于存储后端中的所有键，用于多个环境共享一个 Redis；
+// 租户作用于消息，同一个代理中不同租户的队列、失败队列和结果相互隔离
+
+// NamespacedBackend 给所有的键加上命名空间前缀，例如 staging:maatq:default
+type NamespacedBackend struct {
+	backend Backend
+	prefix  string
+}
+
+func NewNamespacedBackend(backend Backend, namespace string) *NamespacedBackend {
+	return &NamespacedBackend{backend: backend, prefix: namespace + ":"}
+}
+
+func (b *NamespacedBackend) key(k string) string {
+	return b.prefix + k
+}
+
+func (b *NamespacedBackend) keys(keys []string) []string {
+	rv := make([]string, len(keys))
+	for i, k := range keys {
+		rv[i] = b.key(k)
+	}
+	return rv
+}
+
+func (b *NamespacedBackend) unkey(k string) string {
+	return strings.TrimPrefix(k, b.prefix)
+}
+
+func (b *NamespacedBackend) Ping() error {
+	return b.backend.Ping()
+}
+
+func (b *NamespacedBackend) Close() error {
+	return b.backend.Close()
+}
+
+func (b *NamespacedBackend) Push(queue string, data []byte) error {
+	return b.backend.Push(b.key(queue), data)
+}
+
+// PushBatch 底层的存储后端不支持批量写入时逐条写入，失败时可能已经写入了一部分
+func (b *NamespacedBackend) PushBatch(entries []QueueEntry) error {
+	prefixed := make([]QueueEntry, len(entries))
+	for i, e := range entries {
+		prefixed[i] = QueueEntry{Queue: b.key(e.Queue), Data: e.Data}
+	}
+	_, err := pushBatch(b.backend, prefixed)
+	return err
+}
+
+func (b *NamespacedBackend) PushFront(queue string, data []byte) error {
+	return b.backend.PushFront(b.key(queue), data)
+}
+
+func (b *NamespacedBackend) Pop(timeout time.Duration, queues ...string) (string, []byte, error) {
+	queue, data, err := b.backend.Pop(timeout, b.keys(queues)...)
+	return b.unkey(queue), data, err
+}
+
+// PopWithAck 底层的存储后端不需要确认时，返回的确认编号为空
+func (b *NamespacedBackend) PopWithAck(timeout time.Duration, queues ...string) (string, []byte, string, error) {
+	acker, ok := b.backend.(Acker)
+	if !ok {
+		queue, data, err := b.Pop(timeout, queues...)
+		return queue, data, "", err
+	}
+	queue, data, id, err := acker.PopWithAck(timeout, b.keys(queues)...)
+	return b.unkey(queue), data, id, err
+}
+
+func (b *NamespacedBackend) Ack(queue, id string) error {
+	if acker, ok := b.backend.(Acker); ok {
+		return acker.Ack(b.key(queue), id)
+	}
+	return nil
+}
+
+func (b *NamespacedBackend) Len(queue string) (int64, error) {
+	return b.backend.Len(b.key(queue))
+}
+
+func (b *NamespacedBackend) Range(queue string, start, stop int64) ([][]byte, error) {
+	return b.backend.Range(b.key(queue), start, stop)
+}
+
+func (b *NamespacedBackend) Get(key string) ([]byte, error) {
+	return b.backend.Get(b.key(key))
+}
+
+func (b *NamespacedBackend) MGet(keys ...string) ([][]byte, error) {
+	return b.backend.MGet(b.keys(keys)...)
+}
+
+func (b *NamespacedBackend) Set(key string, value []byte, ttl time.Duration) error {
+	return b.backend.Set(b.key(key), value, ttl)
+}
+
+func (b *NamespacedBackend) Del(keys ...string) error {
+	return b.backend.Del(b.keys(keys)...)
+}
+
+func (b *NamespacedBackend) SAdd(key string, members ...string) error {
+	return b.backend.SAdd(b.key(key), members...)
+}
+
+func (b *NamespacedBackend) SRem(key string, members ...string) error {
+	return b.backend.SRem(b.key(key), members...)
+}
+
+func (b *NamespacedBackend) SMembers(key string) ([]string, error) {
+	return b.backend.SMembers(b.key(key))
+}
+
+func (b *NamespacedBackend) ZAdd(key string, score float64, member string) error {
+	return b.backend.ZAdd(b.key(key), score, member)
+}
+
+func (b *NamespacedBackend) ZRem(key string, members ...string) error {
+	return b.backend.ZRem(b.key(key), members...)
+}
+
+func (b *NamespacedBackend) ZRangeByScore(key string, min, max float64) ([]string, error) {
+	return b.backend.ZRangeByScore(b.key(key), min, max)
+}
+
+func (b *NamespacedBackend) ZRemRangeByScore(key string, min, max float64) error {
+	return b.backend.ZRemRangeByScore(b.key(key), min, max)
+}
+
+func (b *NamespacedBackend) Lease(key, owner string, ttl time.Duration) (bool, error) {
+	return b.backend.Lease(b.key(key), owner, ttl)
+}
+
+func (b *NamespacedBackend) Release(key, owner string) error {
+	return b.backend.Release(b.key(key), owner)
+}
+
+// 生成租户的键，例如 maatq:default => maatq:tenant:acme:default，
+// 没有 maatq: 前缀的键例如消息结果 => maatq:tenant:acme:ID(1)，tenant 为空时不变
+func tenantKey(tenant, key string) string {
+	if len(tenant) == 0 {
+		return key
+	}
+	return keyPrefix + "tenant:" + tenant + ":" + strings.TrimPrefix(key, keyPrefix)
+}
+
+// 去掉租户的前缀，tenantKey 的逆操作，例如 maatq:tenant:acme:default => maatq:default，
+// 不是租户的键时不变
+func untenantKey(key string) string {
+	rest := strings.TrimPrefix(key, keyPrefix+"tenant:")
+	if len(rest) == len(key) {
+		return key
+	}
+	i := strings.IndexByte(rest, ':')
+	if i < 0 {
+		return key
+	}
+	return keyPrefix + rest[i+1:]
+}
+
+// 生成租户的完整队列名称
+func tenantQueueName(tenant, q string) string {
+	return tenantKey(tenant, queueName(q))
+}
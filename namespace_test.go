@@ -0,0 +1,89 @@
+package maatq
+
+import "testing"
+
+func TestNamespacedBackend(t *testing.T) {
+	memory := NewMemoryBackend()
+	b := NewNamespacedBackend(memory, "staging")
+	b.Push(DefaultQueue, []byte("a"))
+	b.Set("ID(1)", []byte("ok"), 0)
+
+	if n, _ := memory.Len("staging:" + DefaultQueue); n != 1 {
+		t.Error("队列应该加上命名空间前缀")
+	}
+	if _, err := memory.Get("ID(1)"); err != ErrNil {
+		t.Error("键应该加上命名空间前缀")
+	}
+	queue, _, _, err := b.PopWithAck(drainPollTimeout, DefaultQueue)
+	if err != nil || queue != DefaultQueue {
+		t.Error("返回的队列名称不应该包含命名空间: ", queue, err)
+	}
+}
+
+func TestTenantKey(t *testing.T) {
+	if k := tenantKey("", DefaultQueue); k != DefaultQueue {
+		t.Error("没有租户时键不变: ", k)
+	}
+	if k := tenantQueueName("acme", "sms"); k != "maatq:tenant:acme:sms" {
+		t.Error("租户队列名称错误: ", k)
+	}
+	if k := tenantKey("acme", "ID(1)"); k != "maatq:tenant:acme:ID(1)" {
+		t.Error("租户结果键错误: ", k)
+	}
+	if k := untenantKey(tenantQueueName("acme", "sms")); k != queueName("sms") {
+		t.Error("去掉租户前缀的键错误: ", k)
+	}
+	if k := untenantKey(DefaultQueue); k != DefaultQueue {
+		t.Error("不是租户的键不应该改变: ", k)
+	}
+}
+
+func TestBrokerTenants(t *testing.T) {
+	b := newTestBroker(t, &BrokerOptions{Try: 1, Tenants: []string{"acme"}, Namespace: "staging"})
+	b.AddEventHandler("hello", func(arg interface{}) (interface{}, error) {
+		return arg, nil
+	})
+	b.Enqueue((&Message{Tenant: "acme"}).GetWorkQueue(), &Message{Id: "ID(1)", Event: "hello", Data: "acme", Tenant: "acme"})
+	b.Enqueue(DefaultQueue, &Message{Id: "ID(1)", Event: "hello", Data: "default"})
+	b.Enqueue(DefaultQueue, &Message{Id: "ID(2)", Event: "missing"})
+
+	stats, err := b.Stats("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Queues["default"] != 1 {
+		t.Error("租户队列的消息数量错误: ", stats.Queues)
+	}
+
+	if n := b.Drain(); n != 3 {
+		t.Error("处理的消息数量错误: ", n)
+	}
+	// 不同租户的结果相互隔离
+	if r, err := b.TenantResult("acme", "ID(1)"); err != nil || r.Data != "acme" {
+		t.Error("租户的处理结果错误: ", r, err)
+	}
+	if r, err := b.Result("ID(1)"); err != nil || r.Data != "default" {
+		t.Error("处理结果错误: ", r, err)
+	}
+	if stats, _ := b.Stats(""); stats.Queues["default"] != 0 {
+		t.Error("队列应该为空: ", stats.Queues)
+	}
+}
+
+func TestBrokerOptionsReuse(t *testing.T) {
+	memory := NewMemoryBackend()
+	config := &BrokerOptions{Backend: memory, Namespace: "staging", Queues: []string{"default"}, Parallel: 1}
+	for i := 0; i < 2; i++ {
+		b, err := NewBroker(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Enqueue(DefaultQueue, &Message{Event: "hello"})
+	}
+	if config.Backend != memory {
+		t.Error("创建代理不应该修改配置中的存储后端")
+	}
+	if n, _ := memory.Len("staging:" + DefaultQueue); n != 2 {
+		t.Error("重复使用配置时命名空间应该只加一次: ", n)
+	}
+}
@@ -0,0 +1,138 @@
+package maatq
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// 队列的暂停和恢复，暂停的队列仍然可以写入消息，但是不会被消费
+
+const (
+	MAATQ_PAUSED_KEY = "maatq:paused"
+
+	DefaultPollTimeout = time.Second
+)
+
+// queuePauser 记录被暂停的队列
+// 集群范围的暂停保存在 Redis 集合中，本地的暂停只对当前代理生效
+type queuePauser struct {
+	mu        sync.RWMutex
+	backend   Backend
+	local     map[string]bool
+	cluster   map[string]bool
+	refreshed time.Time
+	interval  time.Duration
+}
+
+func newQueuePauser(backend Backend, interval time.Duration) *queuePauser {
+	return &queuePauser{
+		backend:  backend,
+		local:    make(map[string]bool),
+		cluster:  make(map[string]bool),
+		interval: interval,
+	}
+}
+
+// Pause 暂停队列，local 为 true 时只暂停当前代理
+func (p *queuePauser) Pause(queue string, local bool) error {
+	if local {
+		p.mu.Lock()
+		p.local[queue] = true
+		p.mu.Unlock()
+		return nil
+	}
+	if err := p.backend.SAdd(MAATQ_PAUSED_KEY, queue); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.cluster[queue] = true
+	p.mu.Unlock()
+	return nil
+}
+
+// Resume 恢复队列，local 为 true 时只恢复当前代理的暂停
+func (p *queuePauser) Resume(queue string, local bool) error {
+	if local {
+		p.mu.Lock()
+		delete(p.local, queue)
+		p.mu.Unlock()
+		return nil
+	}
+	if err := p.backend.SRem(MAATQ_PAUSED_KEY, queue); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	delete(p.cluster, queue)
+	p.mu.Unlock()
+	return nil
+}
+
+// 从 Redis 同步集群范围的暂停状态，两次同步之间至少间隔 interval
+func (p *queuePauser) refresh() {
+	p.mu.RLock()
+	fresh := time.Since(p.refreshed) < p.interval
+	p.mu.RUnlock()
+	if fresh {
+		return
+	}
+
+	queues, err := p.backend.SMembers(MAATQ_PAUSED_KEY)
+	if err != nil {
+		log.WithError(err).Error("Refresh paused queues error")
+		return
+	}
+	cluster := make(map[string]bool, len(queues))
+	for _, q := range queues {
+		cluster[q] = true
+	}
+	p.mu.Lock()
+	p.cluster = cluster
+	p.refreshed = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *queuePauser) isPaused(queue string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.local[queue] || p.cluster[queue]
+}
+
+// 过滤掉被暂停的队列
+func (p *queuePauser) active(queues []string) []string {
+	p.refresh()
+	rv := make([]string, 0, len(queues))
+	for _, q := range queues {
+		if !p.isPaused(q) {
+			rv = append(rv, q)
+		}
+	}
+	return rv
+}
+
+// PausedQueues 返回被暂停的队列
+type PausedQueues struct {
+	Cluster []string `json:"cluster"`
+	Local   []string `json:"local"`
+}
+
+func (p *queuePauser) paused() *PausedQueues {
+	p.refresh()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	v := &PausedQueues{
+		Cluster: make([]string, 0, len(p.cluster)),
+		Local:   make([]string, 0, len(p.local)),
+	}
+	for q := range p.cluster {
+		v.Cluster = append(v.Cluster, q)
+	}
+	for q := range p.local {
+		v.Local = append(v.Local, q)
+	}
+	sort.Strings(v.Cluster)
+	sort.Strings(v.Local)
+	return v
+}
@@ -0,0 +1,29 @@
+package maatq
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueuePauserLocal(t *testing.T) {
+	p := newQueuePauser(nil, time.Hour)
+	p.refreshed = time.Now()
+	p.cluster["maatq:email"] = true
+
+	queues := []string{"maatq:sms", "maatq:email", "maatq:push"}
+	p.Pause("maatq:sms", true)
+	if v := p.active(queues); !reflect.DeepEqual(v, []string{"maatq:push"}) {
+		t.Error("暂停的队列不应该被消费: ", v)
+	}
+
+	v := p.paused()
+	if !reflect.DeepEqual(v.Local, []string{"maatq:sms"}) || !reflect.DeepEqual(v.Cluster, []string{"maatq:email"}) {
+		t.Error("暂停的队列列表错误: ", v)
+	}
+
+	p.Resume("maatq:sms", true)
+	if v := p.active(queues); !reflect.DeepEqual(v, []string{"maatq:sms", "maatq:push"}) {
+		t.Error("恢复的队列应该被消费: ", v)
+	}
+}
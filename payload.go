@@ -0,0 +1,184 @@
+package maatq
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// 消息体的编码和解码
+// 生产者在写入队列或者调度器前调用 encode，Worker 在调用处理函数前调用 decode
+// 数据依次经过压缩、加密，超过阈值时转存到 BlobStore
+// 编码后的消息体是二进制数据，以 base64 字符串保存在 data 字段或者 BlobStore 中，
+// 依次使用的编码记录在 encoding 字段中
+
+const (
+	blobKeyPrefix = "maatq:blob:"
+)
+
+var (
+	ErrNoBlobStore     = errors.New("message data stored in blob but no blob store configured")
+	ErrInvalidEncoding = errors.New("encoded message data should be a base64 string")
+	ErrNoKeyring       = errors.New("message data encrypted but no keyring configured")
+)
+
+type payloadPipeline struct {
+	blobs             BlobStore
+	offloadThreshold  int
+	compressor        Compressor
+	compressThreshold int
+	keyring           *Keyring
+	namespace         string // 转存键的命名空间前缀，例如 staging:
+}
+
+func newPayloadPipeline(blobs BlobStore, offloadThreshold int) *payloadPipeline {
+	return &payloadPipeline{
+		blobs:            blobs,
+		offloadThreshold: offloadThreshold,
+	}
+}
+
+// 设置压缩算法，数据超过 threshold 字节时压缩
+func (p *payloadPipeline) setCompressor(c Compressor, threshold int) {
+	p.compressor = c
+	p.compressThreshold = threshold
+}
+
+// 设置密钥，生产者使用主密钥加密，Worker 根据消息中的密钥编号解密
+func (p *payloadPipeline) setKeyring(k *Keyring) {
+	p.keyring = k
+}
+
+// 编码消息体，pinned 为 true 表示数据会被周期任务重复使用，Worker 处理完后不能删除
+func (p *payloadPipeline) encode(m *Message, pinned bool) error {
+	return p.encodeData(m, pinned, false)
+}
+
+// 编码替换任务的新数据，转存时使用新的键，不覆盖旧的任务正在使用的数据
+func (p *payloadPipeline) encodeReplacement(m *Message, pinned bool) error {
+	return p.encodeData(m, pinned, true)
+}
+
+func (p *payloadPipeline) encodeData(m *Message, pinned, fresh bool) error {
+	if m.Data == nil || len(m.DataRef) > 0 || len(m.Encoding) > 0 {
+		return nil
+	}
+	b, err := json.Marshal(m.Data)
+	if err != nil {
+		return err
+	}
+
+	var encodings []string
+	if p.compressor != nil && len(b) > p.compressThreshold {
+		if b, err = p.compressor.Compress(b); err != nil {
+			return err
+		}
+		encodings = append(encodings, p.compressor.Name())
+	}
+
+	if len(m.Id) == 0 {
+		m.Id = uuid.New().String()
+	}
+
+	if p.keyring != nil {
+		id, key, err := p.keyring.primaryKey()
+		if err != nil {
+			return err
+		}
+		if b, err = encrypt(key, b, []byte(m.Id)); err != nil {
+			return err
+		}
+		encodings = append(encodings, encryptionName)
+		m.KeyId = id
+	}
+
+	offload := p.blobs != nil && p.offloadThreshold > 0 && len(b) > p.offloadThreshold
+	if len(encodings) == 0 && !offload {
+		return nil
+	}
+
+	m.Encoding = strings.Join(encodings, ",")
+	if !offload {
+		m.Data = base64.StdEncoding.EncodeToString(b)
+		return nil
+	}
+
+	key := p.namespace + tenantKey(m.Tenant, blobKeyPrefix+m.Id)
+	if fresh {
+		key += ":" + uuid.New().String()
+	}
+	if err := p.blobs.Put(key, b); err != nil {
+		return err
+	}
+	m.Data = nil
+	m.DataRef = key
+	m.DataPinned = pinned
+	return nil
+}
+
+// 还原消息体
+func (p *payloadPipeline) decode(m *Message) error {
+	if len(m.DataRef) == 0 && len(m.Encoding) == 0 {
+		return nil
+	}
+	b, err := p.raw(m)
+	if err != nil {
+		return err
+	}
+	if len(m.Encoding) > 0 {
+		encodings := strings.Split(m.Encoding, ",")
+		for i := len(encodings) - 1; i >= 0; i-- {
+			if b, err = p.decodeStep(m, encodings[i], b); err != nil {
+				return err
+			}
+		}
+	}
+	m.Data = nil
+	m.Encoding = ""
+	m.KeyId = ""
+	return json.Unmarshal(b, &m.Data)
+}
+
+func (p *payloadPipeline) decodeStep(m *Message, encoding string, b []byte) ([]byte, error) {
+	if encoding == encryptionName {
+		if p.keyring == nil {
+			return nil, ErrNoKeyring
+		}
+		key, err := p.keyring.get(m.KeyId)
+		if err != nil {
+			return nil, err
+		}
+		return decrypt(key, b, []byte(m.Id))
+	}
+	c, err := GetCompressor(encoding)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decompress(b)
+}
+
+// 获取编码后的二进制消息体
+func (p *payloadPipeline) raw(m *Message) ([]byte, error) {
+	if len(m.DataRef) > 0 {
+		if p.blobs == nil {
+			return nil, ErrNoBlobStore
+		}
+		return p.blobs.Get(m.DataRef)
+	}
+	s, ok := m.Data.(string)
+	if !ok {
+		return nil, ErrInvalidEncoding
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// 消息处理完成后回收不再使用的数据
+func (p *payloadPipeline) release(m *Message) error {
+	if len(m.DataRef) == 0 || m.DataPinned || p.blobs == nil {
+		return nil
+	}
+	return p.blobs.Delete(m.DataRef)
+}
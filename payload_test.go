@@ -0,0 +1,243 @@
+package maatq
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPayloadOffload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maatq-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPayloadPipeline(store, 64)
+
+	small := &Message{Id: "ID(1)", Event: "hello", Data: "yuez"}
+	if err := p.encode(small, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(small.DataRef) > 0 || small.Data != "yuez" {
+		t.Error("小消息不应该被转存")
+	}
+
+	data := map[string]interface{}{"body": strings.Repeat("x", 128)}
+	m := &Message{Id: "ID(2)", Event: "hello", Data: data}
+	if err := p.encode(m, false); err != nil {
+		t.Fatal(err)
+	}
+	if m.Data != nil || m.DataRef != blobKeyPrefix+"ID(2)" {
+		t.Fatal("大消息应该被转存: ", m.DataRef)
+	}
+
+	if err := p.decode(m); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Data, data) {
+		t.Error("还原的数据错误: ", m.Data)
+	}
+
+	if err := p.release(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(m.DataRef); err != ErrBlobNotFound {
+		t.Error("处理完成后应该回收数据: ", err)
+	}
+}
+
+func TestFileBlobStoreKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maatq-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 最后一段相同的键不能使用同一个文件
+	a, b := blobKeyPrefix+"reports/daily", blobKeyPrefix+"billing/daily"
+	store.Put(a, []byte("a"))
+	store.Put(b, []byte("b"))
+	if err := store.Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := store.Get(a); err != nil || string(v) != "a" {
+		t.Error("不同的键应该保存在不同的文件中: ", string(v), err)
+	}
+	if _, err := store.Get(b); err != ErrBlobNotFound {
+		t.Error("数据应该已经被删除: ", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 || filepath.Dir(filepath.Join(dir, files[0].Name())) != dir {
+		t.Error("数据应该保存在目录中: ", files)
+	}
+
+	// 升级前保存的数据仍然可以读取和删除
+	legacy := blobKeyPrefix + "ID(1)"
+	if err := ioutil.WriteFile(filepath.Join(dir, "maatq_blob_ID(1)"), []byte("legacy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := store.Get(legacy); err != nil || string(v) != "legacy" {
+		t.Error("应该读取旧版本的文件: ", string(v), err)
+	}
+	if err := store.Delete(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(legacy); err != ErrBlobNotFound {
+		t.Error("应该删除旧版本的文件: ", err)
+	}
+}
+
+func TestPayloadCompress(t *testing.T) {
+	data := map[string]interface{}{"body": strings.Repeat("hello", 100)}
+	for _, name := range []string{"gzip", "zstd", "snappy"} {
+		c, err := GetCompressor(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := newPayloadPipeline(nil, 0)
+		p.setCompressor(c, 64)
+
+		m := &Message{Id: "ID(1)", Event: "hello", Data: data}
+		if err := p.encode(m, false); err != nil {
+			t.Fatal(err)
+		}
+		if m.Encoding != name {
+			t.Errorf("[%s] 消息应该被压缩: %s", name, m.Encoding)
+		}
+		if s, _ := m.Data.(string); len(s) >= 500 {
+			t.Errorf("[%s] 压缩后的数据过大: %d", name, len(s))
+		}
+
+		if err := p.decode(m); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m.Data, data) || len(m.Encoding) > 0 {
+			t.Errorf("[%s] 解压后的数据错误: %v", name, m.Data)
+		}
+	}
+
+	if _, err := GetCompressor("lz4"); err == nil {
+		t.Error("未知的压缩算法应该返回错误")
+	}
+}
+
+func TestPayloadReleaseOnCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maatq-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBroker(t, &BrokerOptions{Scheduler: true, Try: 1, BlobStore: store, OffloadThreshold: 64})
+	data := map[string]interface{}{"body": strings.Repeat("x", 128)}
+
+	// 周期任务的数据在取消时回收
+	p, _ := NewPeriod(60)
+	m := &Message{Id: "ID(1)", Event: "hello", Data: data}
+	if err := b.Period(m, p); err != nil {
+		t.Fatal(err)
+	}
+	pm, _ := b.scheduler.Get("ID(1)")
+	if _, err := store.Get(pm.DataRef); err != nil {
+		t.Fatal("周期任务的数据应该被转存: ", err)
+	}
+	b.scheduler.Cancel("ID(1)")
+	if _, err := store.Get(pm.DataRef); err != ErrBlobNotFound {
+		t.Error("取消任务后应该回收数据: ", err)
+	}
+
+	// 移入失败队列的消息保留数据，便于重新执行
+	b.AddEventHandler("fail", func(arg interface{}) (interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	m = &Message{Id: "ID(2)", Event: "fail", Data: data, Try: 1}
+	if err := b.Enqueue(DefaultQueue, m); err != nil {
+		t.Fatal(err)
+	}
+	b.Drain()
+	if n, _ := b.backend.Len(DefaultFailedQueue); n != 1 {
+		t.Fatal("消息应该移入失败队列: ", n)
+	}
+	if _, err := store.Get(m.DataRef); err != nil {
+		t.Error("移入失败队列后应该保留数据: ", err)
+	}
+}
+
+func TestPayloadRegisterReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maatq-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBroker(t, &BrokerOptions{Scheduler: true, BlobStore: store, OffloadThreshold: 64})
+	data := func(s string) map[string]interface{} {
+		return map[string]interface{}{"body": strings.Repeat(s, 128)}
+	}
+	p, _ := NewPeriod(60)
+	if err := b.Register("report", &Message{Event: "report", Data: data("a")}, p); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := b.scheduler.Get("report")
+
+	// 注册失败时不改变正在使用的数据，也不留下新的数据
+	if err := b.Register("report", &Message{Event: "report", Data: data("b")}, nil); err != ErrUnknownRecurrence {
+		t.Fatal("未知的周期应该返回错误: ", err)
+	}
+	if v, err := store.Get(first.DataRef); err != nil || !bytes.Contains(v, []byte("aaaa")) {
+		t.Error("注册失败时不应该覆盖正在使用的数据: ", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Error("注册失败时应该回收新的数据: ", len(files))
+	}
+
+	if err := b.Register("report", &Message{Event: "report", Data: data("c")}, p); err != nil {
+		t.Fatal(err)
+	}
+	pm, _ := b.scheduler.Get("report")
+	if pm.DataRef == first.DataRef {
+		t.Fatal("替换的数据应该使用新的键")
+	}
+	if _, err := store.Get(first.DataRef); err != ErrBlobNotFound {
+		t.Error("替换后应该回收旧的数据: ", err)
+	}
+	if v, err := store.Get(pm.DataRef); err != nil || !bytes.Contains(v, []byte("cccc")) {
+		t.Error("替换后的数据错误: ", err)
+	}
+
+	// 修改任务失败时回收在锁外转存的新数据
+	if _, err := b.UpdateSchedule("report", &ScheduleUpdate{Data: data("d"), Period: p, Once: true}); err != ErrConflictingUpdate {
+		t.Fatal("同时修改多个周期应该返回错误: ", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Error("修改失败时应该回收新的数据: ", len(files))
+	}
+	if _, err := b.UpdateSchedule("report", &ScheduleUpdate{Data: data("e")}); err != nil {
+		t.Fatal(err)
+	}
+	updated, _ := b.scheduler.Get("report")
+	if _, err := store.Get(pm.DataRef); err != ErrBlobNotFound {
+		t.Error("修改后应该回收旧的数据: ", err)
+	}
+	if v, err := store.Get(updated.DataRef); err != nil || !bytes.Contains(v, []byte("eeee")) || !updated.DataPinned {
+		t.Error("修改后的数据错误: ", err)
+	}
+}
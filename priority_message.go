@@ -12,6 +12,8 @@ type PriorityMessage struct {
 	Message
 	T int64      `json:"t"` // 下一次执行的时间
 	P Periodicor `json:"p"` // 周期
+	// 暂停的周期任务不会被执行，恢复时按周期重新计算执行时间
+	Paused bool `json:"paused,omitempty"`
 }
 
 func (pm *PriorityMessage) IsDue() bool {
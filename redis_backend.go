@@ -0,0 +1,307 @@
+package maatq
+
+import (
+	"crypto/tls"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisOptions Redis 连接配置
+// MasterName 不为空时通过 Sentinel 连接，Cluster 为 true 时连接 Redis Cluster，否则连接单个节点
+type RedisOptions struct {
+	Addrs      []string // 节点地址，Sentinel 和 Cluster 模式下为种子节点
+	MasterName string   // Sentinel 的主节点名称
+	Cluster    bool
+	Password   string
+	DB         int    // Cluster 模式下无效
+	Namespace  string // 所有键的命名空间前缀，例如 staging => staging:maatq:default
+	TLSConfig  *tls.Config
+
+	PoolSize     int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// RedisBackend 使用 Redis 的存储后端
+// Cluster 模式下键名的第一段作为哈希标签，保证 BLPOP 和 MGET 等多键命令落在同一个槽
+type RedisBackend struct {
+	client    redis.UniversalClient
+	hashTag   bool
+	namespace string
+}
+
+// 根据配置创建存储后端，backend 不为空时只加上命名空间，
+// 否则使用 Redis 连接配置，streams 不为空时部分队列使用 Redis Streams
+func openBackend(backend Backend, opt *RedisOptions, namespace string, streams *StreamOptions) Backend {
+	if backend != nil {
+		if len(namespace) > 0 {
+			return NewNamespacedBackend(backend, namespace)
+		}
+		return backend
+	}
+	if len(namespace) > 0 {
+		v := *opt
+		v.Namespace = namespace
+		opt = &v
+	}
+	rb := NewRedisBackendWithOptions(opt)
+	if streams != nil {
+		return NewStreamBackend(rb, streams)
+	}
+	return rb
+}
+
+func NewRedisBackend(addr, password string) *RedisBackend {
+	return NewRedisBackendWithOptions(&RedisOptions{
+		Addrs:    []string{addr},
+		Password: password,
+	})
+}
+
+func NewRedisBackendWithOptions(opt *RedisOptions) *RedisBackend {
+	b := &RedisBackend{hashTag: opt.Cluster}
+	if len(opt.Namespace) > 0 {
+		b.namespace = opt.Namespace + ":"
+	}
+	switch {
+	case len(opt.MasterName) > 0:
+		b.client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    opt.MasterName,
+			SentinelAddrs: opt.Addrs,
+			Password:      opt.Password,
+			DB:            opt.DB,
+			TLSConfig:     opt.TLSConfig,
+			PoolSize:      opt.PoolSize,
+			DialTimeout:   opt.DialTimeout,
+			ReadTimeout:   opt.ReadTimeout,
+			WriteTimeout:  opt.WriteTimeout,
+		})
+	case opt.Cluster:
+		b.client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        opt.Addrs,
+			Password:     opt.Password,
+			TLSConfig:    opt.TLSConfig,
+			PoolSize:     opt.PoolSize,
+			DialTimeout:  opt.DialTimeout,
+			ReadTimeout:  opt.ReadTimeout,
+			WriteTimeout: opt.WriteTimeout,
+		})
+	default:
+		var addr string
+		if len(opt.Addrs) > 0 {
+			addr = opt.Addrs[0]
+		}
+		b.client = redis.NewClient(&redis.Options{
+			Addr:         addr,
+			Password:     opt.Password,
+			DB:           opt.DB,
+			TLSConfig:    opt.TLSConfig,
+			PoolSize:     opt.PoolSize,
+			DialTimeout:  opt.DialTimeout,
+			ReadTimeout:  opt.ReadTimeout,
+			WriteTimeout: opt.WriteTimeout,
+		})
+	}
+	return b
+}
+
+// Client 返回底层的 Redis 客户端，例如用于 RedisBlobStore
+func (b *RedisBackend) Client() redis.UniversalClient {
+	return b.client
+}
+
+// 把键名转换成 Redis 中实际的键名，加上命名空间前缀，
+// Cluster 模式下第一段作为哈希标签，例如 maatq:default => {maatq}:default
+func (b *RedisBackend) key(k string) string {
+	k = b.namespace + k
+	if !b.hashTag || strings.HasPrefix(k, "{") {
+		return k
+	}
+	i := strings.Index(k, ":")
+	if i <= 0 {
+		return k
+	}
+	return "{" + k[:i] + "}" + k[i:]
+}
+
+func (b *RedisBackend) keys(keys []string) []string {
+	rv := make([]string, len(keys))
+	for i, k := range keys {
+		rv[i] = b.key(k)
+	}
+	return rv
+}
+
+// 把 Redis 中实际的键名转换回来
+func (b *RedisBackend) unkey(k string) string {
+	if b.hashTag && strings.HasPrefix(k, "{") {
+		if i := strings.Index(k, "}:"); i > 0 {
+			k = k[1:i] + k[i+1:]
+		}
+	}
+	return strings.TrimPrefix(k, b.namespace)
+}
+
+func (b *RedisBackend) Ping() error {
+	return b.client.Ping().Err()
+}
+
+func (b *RedisBackend) Close() error {
+	return b.client.Close()
+}
+
+func (b *RedisBackend) Push(queue string, data []byte) error {
+	return b.client.RPush(b.key(queue), data).Err()
+}
+
+// PushBatch 使用 MULTI/EXEC 在一次往返中写入所有消息
+func (b *RedisBackend) PushBatch(entries []QueueEntry) error {
+	_, err := b.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, e := range entries {
+			pipe.RPush(b.key(e.Queue), e.Data)
+		}
+		return nil
+	})
+	return err
+}
+
+func (b *RedisBackend) PushFront(queue string, data []byte) error {
+	return b.client.LPush(b.key(queue), data).Err()
+}
+
+func (b *RedisBackend) Pop(timeout time.Duration, queues ...string) (string, []byte, error) {
+	result, err := b.client.BLPop(timeout, b.keys(queues)...).Result()
+	if err == redis.Nil {
+		return "", nil, ErrNil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return b.unkey(result[0]), []byte(result[1]), nil
+}
+
+func (b *RedisBackend) Len(queue string) (int64, error) {
+	return b.client.LLen(b.key(queue)).Result()
+}
+
+func (b *RedisBackend) Range(queue string, start, stop int64) ([][]byte, error) {
+	values, err := b.client.LRange(b.key(queue), start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	rv := make([][]byte, len(values))
+	for i, v := range values {
+		rv[i] = []byte(v)
+	}
+	return rv, nil
+}
+
+func (b *RedisBackend) Get(key string) ([]byte, error) {
+	v, err := b.client.Get(b.key(key)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNil
+	}
+	return v, err
+}
+
+// MGet 不存在的键对应的值为 nil
+func (b *RedisBackend) MGet(keys ...string) ([][]byte, error) {
+	values, err := b.client.MGet(b.keys(keys)...).Result()
+	if err != nil {
+		return nil, err
+	}
+	rv := make([][]byte, len(values))
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			rv[i] = []byte(s)
+		}
+	}
+	return rv, nil
+}
+
+func (b *RedisBackend) Set(key string, value []byte, ttl time.Duration) error {
+	return b.client.Set(b.key(key), value, ttl).Err()
+}
+
+func (b *RedisBackend) Del(keys ...string) error {
+	return b.client.Del(b.keys(keys)...).Err()
+}
+
+func (b *RedisBackend) SAdd(key string, members ...string) error {
+	return b.client.SAdd(b.key(key), stringsToInterfaces(members)...).Err()
+}
+
+func (b *RedisBackend) SRem(key string, members ...string) error {
+	return b.client.SRem(b.key(key), stringsToInterfaces(members)...).Err()
+}
+
+func (b *RedisBackend) SMembers(key string) ([]string, error) {
+	return b.client.SMembers(b.key(key)).Result()
+}
+
+func (b *RedisBackend) ZAdd(key string, score float64, member string) error {
+	return b.client.ZAdd(b.key(key), redis.Z{Score: score, Member: member}).Err()
+}
+
+func (b *RedisBackend) ZRem(key string, members ...string) error {
+	return b.client.ZRem(b.key(key), stringsToInterfaces(members)...).Err()
+}
+
+func (b *RedisBackend) ZRangeByScore(key string, min, max float64) ([]string, error) {
+	return b.client.ZRangeByScore(b.key(key), redis.ZRangeBy{
+		Min: formatScore(min),
+		Max: formatScore(max),
+	}).Result()
+}
+
+func (b *RedisBackend) ZRemRangeByScore(key string, min, max float64) error {
+	return b.client.ZRemRangeByScore(b.key(key), formatScore(min), formatScore(max)).Err()
+}
+
+var (
+	leaseScript = redis.NewScript(`
+local v = redis.call("GET", KEYS[1])
+if v == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+if not v then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0`)
+
+	releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+func (b *RedisBackend) Lease(key, owner string, ttl time.Duration) (bool, error) {
+	n, err := leaseScript.Run(b.client, []string{b.key(key)}, owner, int64(ttl/time.Millisecond)).Int64()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (b *RedisBackend) Release(key, owner string) error {
+	return releaseScript.Run(b.client, []string{b.key(key)}, owner).Err()
+}
+
+func formatScore(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func stringsToInterfaces(s []string) []interface{} {
+	rv := make([]interface{}, len(s))
+	for i, v := range s {
+		rv[i] = v
+	}
+	return rv
+}
@@ -0,0 +1,39 @@
+package maatq
+
+import "testing"
+
+func TestRedisBackendHashTag(t *testing.T) {
+	b := NewRedisBackendWithOptions(&RedisOptions{Addrs: []string{"localhost:7000"}, Cluster: true})
+	defer b.Close()
+
+	if k := b.key(DefaultQueue); k != "{maatq}:default" {
+		t.Error("Cluster 模式下键名应该使用哈希标签: ", k)
+	}
+	if k := b.unkey(b.key(DefaultQueue)); k != DefaultQueue {
+		t.Error("键名转换错误: ", k)
+	}
+	// 不是 maatq: 开头的键保持不变，例如消息结果
+	if k := b.key("ID(1)"); k != "ID(1)" {
+		t.Error("键名不应该改变: ", k)
+	}
+
+	single := NewRedisBackend("localhost:6379", "")
+	defer single.Close()
+	if k := single.key(DefaultQueue); k != DefaultQueue {
+		t.Error("单节点模式下键名不应该改变: ", k)
+	}
+}
+
+func TestRedisBackendHashTagWithNamespace(t *testing.T) {
+	b := NewRedisBackendWithOptions(&RedisOptions{Addrs: []string{"localhost:7000"}, Cluster: true})
+	defer b.Close()
+
+	// 命名空间作为哈希标签，同一个命名空间的键落在同一个槽
+	k := b.key("staging:" + DefaultQueue)
+	if k != "{staging}:maatq:default" {
+		t.Error("键名错误: ", k)
+	}
+	if k := b.unkey(k); k != "staging:"+DefaultQueue {
+		t.Error("键名转换错误: ", k)
+	}
+}
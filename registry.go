@@ -0,0 +1,134 @@
+package maatq
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// Worker 注册表，每个 Worker 定时把自己的状态写入 Redis
+
+const (
+	MAATQ_WORKERS_KEY = "maatq:workers"
+
+	DefaultHeartbeatInterval = 10 * time.Second
+	DefaultWorkerTTL         = 3 * DefaultHeartbeatInterval
+)
+
+// WorkerInfo Worker 在注册表中的状态
+type WorkerInfo struct {
+	Key       string   `json:"key"`
+	Host      string   `json:"host"`
+	Pid       int      `json:"pid"`
+	WorkerId  int      `json:"worker_id"`
+	Queues    []string `json:"queues"`
+	Events    []string `json:"events"`
+	StartedAt int64    `json:"started_at"`
+	Heartbeat int64    `json:"heartbeat"`
+
+	// 正在处理的消息
+	MessageId        string `json:"message_id,omitempty"`
+	MessageEvent     string `json:"message_event,omitempty"`
+	MessageStartedAt int64  `json:"message_started_at,omitempty"`
+}
+
+var hostname = func() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return h
+}()
+
+func workerKey(id int) string {
+	return fmt.Sprintf("maatq:worker:%s:%d:%d", hostname, os.Getpid(), id)
+}
+
+// 生成 Worker 当前的状态
+func (w *Worker) info() *WorkerInfo {
+	w.stateMu.RLock()
+	defer w.stateMu.RUnlock()
+
+	events := make([]string, 0, len(w.eventHandlers))
+	for e := range w.eventHandlers {
+		events = append(events, e)
+	}
+	sort.Strings(events)
+
+	v := &WorkerInfo{
+		Key:       workerKey(w.Id),
+		Host:      hostname,
+		Pid:       os.Getpid(),
+		WorkerId:  w.Id,
+		Queues:    w.queues,
+		Events:    events,
+		StartedAt: w.startedAt.Unix(),
+		Heartbeat: time.Now().Unix(),
+	}
+	if w.current != nil {
+		v.MessageId = w.current.Msg.Id
+		v.MessageEvent = w.current.Msg.Event
+		v.MessageStartedAt = w.current.StartTime.Unix()
+	}
+	return v
+}
+
+func (w *Worker) setCurrent(hm *handlingMessage) {
+	w.stateMu.Lock()
+	w.current = hm
+	w.stateMu.Unlock()
+}
+
+// 把 Worker 状态写入注册表，过期时间为 ttl
+func (w *Worker) register(ttl time.Duration) error {
+	v := w.info()
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := w.backend.Set(v.Key, b, ttl); err != nil {
+		return err
+	}
+	return w.backend.ZAdd(MAATQ_WORKERS_KEY, float64(v.Heartbeat), v.Key)
+}
+
+func (w *Worker) unregister() error {
+	key := workerKey(w.Id)
+	if err := w.backend.Del(key); err != nil {
+		return err
+	}
+	return w.backend.ZRem(MAATQ_WORKERS_KEY, key)
+}
+
+// 列出集群中所有存活的 Worker，同时清理过期的注册项
+func listWorkers(backend Backend, ttl time.Duration) ([]*WorkerInfo, error) {
+	deadline := time.Now().Add(-ttl).Unix()
+	backend.ZRemRangeByScore(MAATQ_WORKERS_KEY, math.Inf(-1), float64(deadline-1))
+
+	keys, err := backend.ZRangeByScore(MAATQ_WORKERS_KEY, math.Inf(-1), math.Inf(1))
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]*WorkerInfo, 0, len(keys))
+	if len(keys) == 0 {
+		return rv, nil
+	}
+	values, err := backend.MGet(keys...)
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		var v WorkerInfo
+		if err := json.Unmarshal(value, &v); err != nil {
+			return nil, err
+		}
+		rv = append(rv, &v)
+	}
+	return rv, nil
+}
@@ -0,0 +1,58 @@
+package maatq
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWorkerInfo(t *testing.T) {
+	w := &Worker{
+		Id:            3,
+		eventHandlers: make(map[string]EventHandler),
+		queues:        []string{"maatq:sms"},
+		startedAt:     time.Now(),
+	}
+	w.AddEventHandler("sms.send", nil)
+	w.AddEventHandler("hello", nil)
+
+	v := w.info()
+	if v.WorkerId != 3 || v.Key != workerKey(3) {
+		t.Error("Worker 标识错误: ", v.Key)
+	}
+	if !reflect.DeepEqual(v.Events, []string{"hello", "sms.send"}) {
+		t.Error("事件列表错误: ", v.Events)
+	}
+	if len(v.MessageId) > 0 {
+		t.Error("空闲的 Worker 不应该有当前消息")
+	}
+
+	w.setCurrent(&handlingMessage{
+		Queue:     "maatq:sms",
+		Msg:       &Message{Id: "ID(1)", Event: "hello"},
+		StartTime: time.Now(),
+	})
+	v = w.info()
+	if v.MessageId != "ID(1)" || v.MessageEvent != "hello" {
+		t.Error("当前消息错误: ", v.MessageId, v.MessageEvent)
+	}
+}
+
+func TestWorkerInfoConcurrentRegister(t *testing.T) {
+	w := &Worker{eventHandlers: make(map[string]EventHandler)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			w.info()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		w.AddEventHandler(fmt.Sprintf("event.%d", i), nil)
+	}
+	<-done
+	if n := len(w.info().Events); n != 100 {
+		t.Error("事件数量错误: ", n)
+	}
+}
@@ -0,0 +1,220 @@
+package maatq
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 调度器任务的持久化格式，使用带版本号的 JSON，周期使用显式的类型，
+// 快照、预写日志和任务存储都使用这个格式，旧版本 gob 编码的快照在读取时自动迁移
+
+const (
+	ScheduleDumpVersion = 1
+
+	RecurrencePeriod  = "period"
+	RecurrenceCrontab = "crontab"
+)
+
+var (
+	ErrUnsupportedDumpVersion = errors.New("unsupported schedule dump version")
+	ErrUnknownRecurrence      = errors.New("unknown recurrence type")
+)
+
+// ScheduleDump 调度器中所有的任务
+type ScheduleDump struct {
+	Version int              `json:"version"`
+	Entries []*ScheduleEntry `json:"entries"`
+}
+
+// ScheduleEntry 一个任务，T 为下一次执行的时间
+type ScheduleEntry struct {
+	Message    *Message    `json:"message"`
+	T          int64       `json:"t"`
+	Recurrence *Recurrence `json:"recurrence,omitempty"`
+	Paused     bool        `json:"paused,omitempty"`
+}
+
+// Recurrence 任务的周期，Type 为 period 时使用 Begin 和 Cycle，为 crontab 时使用 Crontab 和 Timezone
+type Recurrence struct {
+	Type     string `json:"type"`
+	Begin    int64  `json:"begin,omitempty"`
+	Cycle    int64  `json:"cycle,omitempty"`
+	Crontab  string `json:"crontab,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+func newScheduleEntry(pm *PriorityMessage) (*ScheduleEntry, error) {
+	m := pm.Message
+	e := &ScheduleEntry{Message: &m, T: pm.T, Paused: pm.Paused}
+	switch p := pm.P.(type) {
+	case nil:
+	case *Period:
+		e.Recurrence = &Recurrence{Type: RecurrencePeriod, Begin: p.Begin.Unix(), Cycle: p.Cycle}
+	case *Crontab:
+		e.Recurrence = &Recurrence{Type: RecurrenceCrontab, Crontab: p.Text, Timezone: p.Timezone}
+	default:
+		return nil, fmt.Errorf("%v: %T", ErrUnknownRecurrence, pm.P)
+	}
+	return e, nil
+}
+
+func (e *ScheduleEntry) priorityMessage() (*PriorityMessage, error) {
+	if e.Message == nil {
+		return nil, errors.New("schedule entry without message")
+	}
+	pm := &PriorityMessage{Message: *e.Message, T: e.T, Paused: e.Paused}
+	if e.Recurrence == nil {
+		return pm, nil
+	}
+	switch e.Recurrence.Type {
+	case RecurrencePeriod:
+		if e.Recurrence.Cycle <= 0 {
+			return nil, ErrNotPositive
+		}
+		pm.P = &Period{Begin: time.Unix(e.Recurrence.Begin, 0), Cycle: e.Recurrence.Cycle}
+	case RecurrenceCrontab:
+		cron, err := NewCrontabIn(e.Recurrence.Crontab, e.Recurrence.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		pm.P = cron
+	default:
+		return nil, fmt.Errorf("%v: %s", ErrUnknownRecurrence, e.Recurrence.Type)
+	}
+	return pm, nil
+}
+
+func marshalScheduled(pm *PriorityMessage) ([]byte, error) {
+	e, err := newScheduleEntry(pm)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(e)
+}
+
+func unmarshalScheduled(b []byte) (*PriorityMessage, error) {
+	var e ScheduleEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	return e.priorityMessage()
+}
+
+func newScheduleDump(items []*PriorityMessage) (*ScheduleDump, error) {
+	d := &ScheduleDump{Version: ScheduleDumpVersion, Entries: make([]*ScheduleEntry, 0, len(items))}
+	for _, pm := range items {
+		e, err := newScheduleEntry(pm)
+		if err != nil {
+			return nil, err
+		}
+		d.Entries = append(d.Entries, e)
+	}
+	return d, nil
+}
+
+func (d *ScheduleDump) priorityMessages() ([]*PriorityMessage, error) {
+	if d.Version > ScheduleDumpVersion {
+		return nil, fmt.Errorf("%v: %d", ErrUnsupportedDumpVersion, d.Version)
+	}
+	rv := make([]*PriorityMessage, 0, len(d.Entries))
+	for _, e := range d.Entries {
+		pm, err := e.priorityMessage()
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, pm)
+	}
+	return rv, nil
+}
+
+func encodeHeap(h *minHeap) ([]byte, error) {
+	d, err := newScheduleDump(*h.Items)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(d)
+}
+
+// 解析快照，JSON 以 { 开头，否则是旧版本 gob 编码的快照，返回的 legacy 为 true
+func decodeHeap(b []byte) (h *minHeap, legacy bool, err error) {
+	if len(b) > 0 && b[0] == '{' {
+		var d ScheduleDump
+		if err := json.Unmarshal(b, &d); err != nil {
+			return nil, false, err
+		}
+		items, err := d.priorityMessages()
+		if err != nil {
+			return nil, false, err
+		}
+		h = newHeap()
+		for _, pm := range items {
+			h.upsert(pm)
+		}
+		return h, false, nil
+	}
+
+	var v minHeap
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v); err != nil {
+		return nil, true, err
+	}
+	// 空的堆编码后没有 Items
+	if v.Items == nil {
+		items := make([]*PriorityMessage, 0)
+		v.Items = &items
+	}
+	v.reindex()
+	return &v, true, nil
+}
+
+// Export 导出所有任务
+func (s *Scheduler) Export() (*ScheduleDump, error) {
+	items, err := s.items()
+	if err != nil {
+		return nil, err
+	}
+	return newScheduleDump(items)
+}
+
+// Import 导入任务，编号相同的任务被覆盖，replace 为 true 时先取消所有已有的任务，返回导入的任务数量
+func (s *Scheduler) Import(d *ScheduleDump, replace bool) (int, error) {
+	items, err := d.priorityMessages()
+	if err != nil {
+		return 0, err
+	}
+	// 导入的任务可能引用相同的数据，只回收不再使用的数据
+	refs := make(map[string]bool, len(items))
+	for _, pm := range items {
+		refs[pm.DataRef] = true
+	}
+	var removed []*PriorityMessage
+	if replace {
+		current, err := s.Export()
+		if err != nil {
+			return 0, err
+		}
+		for _, e := range current.Entries {
+			if pm, ok := s.cancel(e.Message.Id); ok && pm != nil {
+				removed = append(removed, pm)
+			}
+		}
+	} else {
+		for _, pm := range items {
+			if old, ok := s.cancel(pm.Id); ok && old != nil {
+				removed = append(removed, old)
+			}
+		}
+	}
+	for _, pm := range items {
+		s.schedule(pm)
+	}
+	for _, pm := range removed {
+		if !refs[pm.DataRef] {
+			s.releaseMessage(&pm.Message)
+		}
+	}
+	return len(items), nil
+}
@@ -0,0 +1,99 @@
+package maatq
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestScheduleDumpRoundTrip(t *testing.T) {
+	h := newHeap()
+	p, _ := NewPeriod(60)
+	cron, _ := NewCrontab("*/5 * * * *")
+	heap.Push(h, &PriorityMessage{Message: Message{Id: "ID(1)", Event: "hello"}, T: 100})
+	heap.Push(h, &PriorityMessage{Message: Message{Id: "ID(2)", Event: "hello"}, T: 200, P: p})
+	heap.Push(h, &PriorityMessage{Message: Message{Id: "ID(3)", Event: "hello"}, T: 300, P: cron})
+
+	b, err := encodeHeap(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, legacy, err := decodeHeap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy || decoded.Len() != 3 {
+		t.Fatal("解析快照错误: ", string(b))
+	}
+	pm := (*decoded.Items)[decoded.find("ID(2)")]
+	if period, ok := pm.P.(*Period); !ok || period.Cycle != 60 || period.Begin.Unix() != p.Begin.Unix() {
+		t.Error("周期任务解析错误: ", pm.P)
+	}
+	pm = (*decoded.Items)[decoded.find("ID(3)")]
+	if c, ok := pm.P.(*Crontab); !ok || c.Text != "*/5 * * * *" {
+		t.Error("crontab 任务解析错误: ", pm.P)
+	}
+}
+
+func TestScheduleDumpVersion(t *testing.T) {
+	b, _ := json.Marshal(&ScheduleDump{Version: ScheduleDumpVersion + 1})
+	if _, _, err := decodeHeap(b); err == nil {
+		t.Error("应该拒绝不支持的版本")
+	}
+	b = []byte(`{"version":1,"entries":[{"message":{"id":"ID(1)","event":"hello"},"t":1,"recurrence":{"type":"weekly"}}]}`)
+	if _, _, err := decodeHeap(b); err == nil {
+		t.Error("应该拒绝未知的周期类型")
+	}
+}
+
+func TestScheduleDumpMigrateGob(t *testing.T) {
+	backend := NewMemoryBackend()
+	h := newHeap()
+	p, _ := NewPeriod(60)
+	heap.Push(h, &PriorityMessage{Message: Message{Id: "ID(1)", Event: "hello"}, T: 100, P: p})
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(h); err != nil {
+		t.Fatal(err)
+	}
+	backend.Set(MAATQ_DUMPS_KEY, buf.Bytes(), 0)
+
+	s := NewScheduler(backend)
+	loaded, err := s.loads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != 1 || loaded.find("ID(1)") < 0 {
+		t.Error("读取 gob 快照错误: ", loaded)
+	}
+	b, _ := backend.Get(MAATQ_DUMPS_KEY)
+	if len(b) == 0 || b[0] != '{' {
+		t.Error("gob 快照应该被重新保存为 JSON")
+	}
+}
+
+func TestSchedulerExportImport(t *testing.T) {
+	s := NewScheduler(NewMemoryBackend())
+	p, _ := NewPeriod(60)
+	s.Delay(&Message{Id: "ID(1)", Event: "hello"}, time.Hour)
+	s.Period(&Message{Id: "ID(2)", Event: "hello"}, p)
+
+	d, err := s.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Version != ScheduleDumpVersion || len(d.Entries) != 2 {
+		t.Fatal("导出的任务错误: ", d)
+	}
+
+	other := NewScheduler(NewMemoryBackend())
+	other.Delay(&Message{Id: "ID(3)", Event: "hello"}, time.Hour)
+	if n, err := other.Import(d, false); err != nil || n != 2 || other.heap.Len() != 3 {
+		t.Error("合并导入错误: ", n, err, other.heap.Len())
+	}
+	if n, err := other.Import(d, true); err != nil || n != 2 || other.heap.Len() != 2 || other.heap.find("ID(3)") >= 0 {
+		t.Error("替换导入错误: ", n, err, other.heap.Len())
+	}
+}
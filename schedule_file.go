@@ -0,0 +1,328 @@
+package maatq
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// 声明式的调度文件，文件中的周期任务按名称注册到调度器。
+// 代理启动时、文件变化时和收到 SIGHUP 时和调度器对账：
+// 添加新的任务，更新变化的任务，取消文件中已经删除的任务
+
+const (
+	// 保存文件管理的任务名称和内容的摘要，用于判断任务是否变化或者被删除
+	MAATQ_SCHEDULE_FILE_KEY = "maatq:schedule:file"
+
+	// 文件变化后等待这么久再重新加载，编辑器保存一次文件可能产生多个事件
+	scheduleFileDebounce = 500 * time.Millisecond
+)
+
+// ScheduleSpec 调度文件中的一个任务，Crontab 和 Period 必须设置其中一个
+type ScheduleSpec struct {
+	Name     string      `yaml:"name" toml:"name" json:"name"`
+	Event    string      `yaml:"event" toml:"event" json:"event"`
+	Data     interface{} `yaml:"data" toml:"data" json:"data,omitempty"`
+	Queue    string      `yaml:"queue" toml:"queue" json:"queue,omitempty"`
+	Tags     []string    `yaml:"tags" toml:"tags" json:"tags,omitempty"`
+	Crontab  string      `yaml:"crontab" toml:"crontab" json:"crontab,omitempty"`
+	Period   int64       `yaml:"period" toml:"period" json:"period,omitempty"` // 秒
+	Timezone string      `yaml:"timezone" toml:"timezone" json:"timezone,omitempty"`
+	Enabled  *bool       `yaml:"enabled" toml:"enabled" json:"enabled,omitempty"` // 为空时启用
+}
+
+type scheduleFile struct {
+	Schedules []*ScheduleSpec `yaml:"schedules" toml:"schedules"`
+}
+
+// ScheduleDiff 一次对账的结果
+type ScheduleDiff struct {
+	Added   []string `json:"added"`
+	Updated []string `json:"updated"`
+	Removed []string `json:"removed"`
+}
+
+func (d *ScheduleDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Updated) == 0 && len(d.Removed) == 0
+}
+
+func (s *ScheduleSpec) enabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+func (s *ScheduleSpec) recurrence() (Periodicor, error) {
+	if len(s.Crontab) > 0 {
+		return NewCrontabIn(s.Crontab, s.Timezone)
+	}
+	return NewPeriod(s.Period)
+}
+
+func (s *ScheduleSpec) validate() error {
+	if len(s.Event) == 0 {
+		return fmt.Errorf("field event required")
+	}
+	if (len(s.Crontab) > 0) == (s.Period != 0) {
+		return fmt.Errorf("exactly one of crontab and period required")
+	}
+	if len(s.Timezone) > 0 && len(s.Crontab) == 0 {
+		return fmt.Errorf("timezone requires crontab")
+	}
+	_, err := s.recurrence()
+	return err
+}
+
+// 任务内容的摘要，文件中的任务没有变化时不重新注册，避免推迟下次执行的时间
+func (s *ScheduleSpec) hash() (string, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// LoadScheduleFile 读取并校验调度文件，扩展名为 .toml 时按 TOML 解析，否则按 YAML 解析
+func LoadScheduleFile(path string) ([]*ScheduleSpec, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f scheduleFile
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		md, err := toml.Decode(string(b), &f)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range md.Undecoded() {
+			// data 的内容不限制
+			if len(key) > 2 && key[1] == "data" {
+				continue
+			}
+			return nil, fmt.Errorf("unknown field %s", key)
+		}
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(&f); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	names := make(map[string]bool, len(f.Schedules))
+	for i, spec := range f.Schedules {
+		if spec == nil || len(spec.Name) == 0 {
+			return nil, fmt.Errorf("schedule #%d: field name required", i+1)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("schedule %s: duplicate name", spec.Name)
+		}
+		names[spec.Name] = true
+		if err := spec.validate(); err != nil {
+			return nil, fmt.Errorf("schedule %s: %v", spec.Name, err)
+		}
+	}
+	return f.Schedules, nil
+}
+
+// ReloadSchedules 重新读取调度文件并和调度器对账，文件有错误时不做任何改变
+func (b *Broker) ReloadSchedules() (*ScheduleDiff, error) {
+	specs, err := LoadScheduleFile(b.config.ScheduleFile)
+	if err != nil {
+		return nil, err
+	}
+	return b.ReconcileSchedules(specs)
+}
+
+// ReconcileSchedules 使调度器中由调度文件管理的任务和 specs 一致
+// 开启选举时只有 leader 对账，其他代理跳过，成为 leader 后再对账
+func (b *Broker) ReconcileSchedules(specs []*ScheduleSpec) (*ScheduleDiff, error) {
+	if !b.config.Scheduler {
+		return nil, ErrSchedulerDisabled
+	}
+	diff := &ScheduleDiff{}
+	if !b.scheduler.IsLeader() {
+		log.Info("Not leader, schedule file reconciliation skipped")
+		return diff, nil
+	}
+	b.reconcileMu.Lock()
+	defer b.reconcileMu.Unlock()
+
+	applied, err := b.appliedSchedules()
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		h, err := spec.hash()
+		if err != nil {
+			return diff, fmt.Errorf("schedule %s: %v", spec.Name, err)
+		}
+		_, exists := b.scheduler.Get(spec.Name)
+		if !exists || applied[spec.Name] != h {
+			if err := b.applyScheduleSpec(spec); err != nil {
+				return diff, fmt.Errorf("schedule %s: %v", spec.Name, err)
+			}
+			if exists {
+				diff.Updated = append(diff.Updated, spec.Name)
+			} else {
+				diff.Added = append(diff.Added, spec.Name)
+			}
+		}
+		current[spec.Name] = h
+	}
+	for name := range applied {
+		if _, ok := current[name]; ok {
+			continue
+		}
+		b.scheduler.Cancel(name)
+		diff.Removed = append(diff.Removed, name)
+	}
+	sort.Strings(diff.Removed)
+
+	data, err := json.Marshal(current)
+	if err != nil {
+		return diff, err
+	}
+	if err := b.backend.Set(MAATQ_SCHEDULE_FILE_KEY, data, 0); err != nil {
+		return diff, err
+	}
+
+	if !diff.empty() {
+		log.WithFields(log.Fields{
+			"added":   diff.Added,
+			"updated": diff.Updated,
+			"removed": diff.Removed,
+		}).Info("Schedule file reconciled")
+	}
+	return diff, nil
+}
+
+// 上次对账后由调度文件管理的任务名称和摘要
+func (b *Broker) appliedSchedules() (map[string]string, error) {
+	applied := make(map[string]string)
+	data, err := b.backend.Get(MAATQ_SCHEDULE_FILE_KEY)
+	if err == ErrNil {
+		return applied, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &applied); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// 注册任务并按 enabled 暂停或者恢复，状态已经一致时不改变，避免推迟下次执行的时间
+func (b *Broker) applyScheduleSpec(spec *ScheduleSpec) error {
+	p, err := spec.recurrence()
+	if err != nil {
+		return err
+	}
+	m := &Message{
+		Event:     spec.Event,
+		Data:      spec.Data,
+		Queue:     spec.Queue,
+		Tags:      spec.Tags,
+		Timestamp: time.Now().Unix(),
+	}
+	if err := b.Register(spec.Name, m, p); err != nil {
+		return err
+	}
+	pm, ok := b.scheduler.Get(spec.Name)
+	if !ok {
+		return ErrScheduleNotFound
+	}
+	switch {
+	case spec.enabled() && pm.Paused:
+		_, err = b.scheduler.Resume(spec.Name)
+	case !spec.enabled() && !pm.Paused:
+		_, err = b.scheduler.Pause(spec.Name)
+	}
+	return err
+}
+
+// 调度文件的状态，符号链接指向的文件和内容的摘要
+type scheduleFileState struct {
+	target string
+	sum    [sha256.Size]byte
+}
+
+// 读取调度文件的状态，Kubernetes 的 ConfigMap 通过切换目录中的符号链接更新文件，
+// 只有目录中的其他文件有事件，需要比较状态才能发现文件变化
+func statScheduleFile(path string) scheduleFileState {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return scheduleFileState{}
+	}
+	st := scheduleFileState{target: target}
+	if b, err := ioutil.ReadFile(target); err == nil {
+		st.sum = sha256.Sum256(b)
+	}
+	return st
+}
+
+// 文件变化或者收到 SIGHUP 时重新对账，出错时保留当前的任务
+func (b *Broker) watchScheduleFile() {
+	path := filepath.Clean(b.config.ScheduleFile)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		// 监听目录而不是文件，编辑器保存时可能替换文件
+		err = watcher.Add(filepath.Dir(path))
+	}
+	if err != nil {
+		log.WithError(err).Error("Watch schedule file error, reload on SIGHUP only")
+	} else {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	timer := time.NewTimer(scheduleFileDebounce)
+	timer.Stop()
+	state := statScheduleFile(path)
+	reload := func(reason string) {
+		state = statScheduleFile(path)
+		log.Infof("Reloading schedule file %s: %s", path, reason)
+		if _, err := b.ReloadSchedules(); err != nil {
+			log.WithError(err).Error("Reload schedule file error")
+		}
+	}
+	for {
+		select {
+		case <-hup:
+			reload("SIGHUP")
+		case ev := <-events:
+			if ev.Op == fsnotify.Chmod {
+				break
+			}
+			if filepath.Clean(ev.Name) == path || statScheduleFile(path) != state {
+				timer.Reset(scheduleFileDebounce)
+			}
+		case err := <-errs:
+			log.WithError(err).Error("Watch schedule file error")
+		case <-timer.C:
+			reload("file changed")
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package maatq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScheduleFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadScheduleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maatq-schedules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "schedules.toml")
+	writeScheduleFile(t, path, `
+[[schedules]]
+name = "report"
+event = "report.daily"
+crontab = "0 9 * * *"
+timezone = "Asia/Shanghai"
+data = { format = "pdf" }
+
+[[schedules]]
+name = "ping"
+event = "ping"
+period = 60
+enabled = false
+`)
+	specs, err := LoadScheduleFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 || specs[0].Timezone != "Asia/Shanghai" || specs[1].Period != 60 || specs[1].enabled() {
+		t.Error("解析 TOML 调度文件错误: ", specs)
+	}
+
+	cases := map[string]string{
+		"缺少名称":         "schedules:\n  - event: a\n    period: 60\n",
+		"名称重复":         "schedules:\n  - {name: a, event: a, period: 60}\n  - {name: a, event: b, period: 60}\n",
+		"缺少事件":         "schedules:\n  - {name: a, period: 60}\n",
+		"同时设置两个周期":     "schedules:\n  - {name: a, event: a, period: 60, crontab: '* * * * *'}\n",
+		"时区错误":         "schedules:\n  - {name: a, event: a, crontab: '* * * * *', timezone: Mars/Base}\n",
+		"周期任务不支持时区":    "schedules:\n  - {name: a, event: a, period: 60, timezone: UTC}\n",
+		"未知的字段":        "schedules:\n  - {name: a, event: a, period: 60, cron: '* * * * *'}\n",
+		"Crontab 语法错误": "schedules:\n  - {name: a, event: a, crontab: '* *'}\n",
+	}
+	path = filepath.Join(dir, "schedules.yaml")
+	for name, content := range cases {
+		writeScheduleFile(t, path, content)
+		if _, err := LoadScheduleFile(path); err == nil {
+			t.Error(name, "时应该返回错误")
+		}
+	}
+	writeScheduleFile(t, path, "")
+	if specs, err := LoadScheduleFile(path); err != nil || len(specs) != 0 {
+		t.Error("空文件应该没有任务: ", specs, err)
+	}
+}
+
+func TestBrokerReloadSchedules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maatq-schedules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schedules.yaml")
+	writeScheduleFile(t, path, `
+schedules:
+  - name: report
+    event: report.daily
+    crontab: "0 9 * * *"
+    timezone: Asia/Shanghai
+    data: {format: pdf}
+  - name: ping
+    event: ping
+    period: 60
+`)
+
+	b := newTestBroker(t, &BrokerOptions{Scheduler: true, ScheduleFile: path})
+	report, ok := b.scheduler.Get("report")
+	if !ok || report.P.(*Crontab).Timezone != "Asia/Shanghai" {
+		t.Fatal("启动时应该注册调度文件中的任务: ", report)
+	}
+	if _, ok := b.scheduler.Get("ping"); !ok {
+		t.Fatal("启动时应该注册调度文件中的任务")
+	}
+	b.Delay(&Message{Id: "manual", Event: "hello"}, time.Hour)
+
+	// 文件没有变化时不改变任务
+	diff, err := b.ReloadSchedules()
+	if err != nil || len(diff.Added)+len(diff.Updated)+len(diff.Removed) != 0 {
+		t.Error("文件没有变化时不应该改变任务: ", diff, err)
+	}
+
+	writeScheduleFile(t, path, `
+schedules:
+  - name: report
+    event: report.daily
+    crontab: "0 9 * * *"
+    timezone: Asia/Shanghai
+    data: {format: pdf}
+  - name: ping
+    event: ping
+    period: 30
+    enabled: false
+  - name: cleanup
+    event: cleanup
+    period: 3600
+    queue: low
+`)
+	diff, err = b.ReloadSchedules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(diff.Added, ",") != "cleanup" || strings.Join(diff.Updated, ",") != "ping" || len(diff.Removed) != 0 {
+		t.Error("对账的结果错误: ", diff)
+	}
+	ping, _ := b.scheduler.Get("ping")
+	if !ping.Paused || ping.P.(*Period).Cycle != 30 {
+		t.Error("修改后的任务错误: ", ping)
+	}
+	if pm, _ := b.scheduler.Get("report"); pm.T != report.T {
+		t.Error("没有变化的任务不应该推迟执行时间: ", pm.T, report.T)
+	}
+
+	writeScheduleFile(t, path, `
+schedules:
+  - name: cleanup
+    event: cleanup
+    period: 3600
+    queue: low
+`)
+	diff, err = b.ReloadSchedules()
+	if err != nil || strings.Join(diff.Removed, ",") != "ping,report" {
+		t.Error("应该删除文件中已经删除的任务: ", diff, err)
+	}
+	if _, ok := b.scheduler.Get("report"); ok {
+		t.Error("任务应该已经被取消")
+	}
+	if _, ok := b.scheduler.Get("manual"); !ok {
+		t.Error("不应该删除不是调度文件管理的任务")
+	}
+
+	// 文件有错误时保留当前的任务
+	writeScheduleFile(t, path, "schedules:\n  - {name: cleanup}\n")
+	if _, err := b.ReloadSchedules(); err == nil {
+		t.Error("文件有错误时应该返回错误")
+	}
+	if _, ok := b.scheduler.Get("cleanup"); !ok {
+		t.Error("文件有错误时应该保留当前的任务")
+	}
+}
+
+func TestStatScheduleFileSymlinkSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maatq-schedules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 和 ConfigMap 相同的目录结构: schedules.yaml -> ..data/schedules.yaml，..data -> ..v1
+	content := "schedules:\n  - {name: ping, event: ping, period: 60}\n"
+	for _, v := range []string{"..v1", "..v2"} {
+		if err := os.Mkdir(filepath.Join(dir, v), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeScheduleFile(t, filepath.Join(dir, v, "schedules.yaml"), content)
+	}
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "schedules.yaml")
+	if err := os.Symlink(filepath.Join("..data", "schedules.yaml"), path); err != nil {
+		t.Fatal(err)
+	}
+	st := statScheduleFile(path)
+	if len(st.target) == 0 {
+		t.Fatal("应该解析符号链接")
+	}
+
+	// 内容相同时切换符号链接，指向的文件变化
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	swapped := statScheduleFile(path)
+	if swapped == st || swapped.sum != st.sum {
+		t.Error("切换符号链接后状态应该变化: ", swapped.target, st.target)
+	}
+
+	// 原地修改时内容的摘要变化
+	writeScheduleFile(t, filepath.Join(dir, "..v2", "schedules.yaml"), content+"  - {name: pong, event: pong, period: 60}\n")
+	if statScheduleFile(path) == swapped {
+		t.Error("修改内容后状态应该变化")
+	}
+}
@@ -0,0 +1,525 @@
+package maatq
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// 定时任务的持久化存储，任务按到期时间保存在有序集合中，
+// 每个任务另外保存两个键：写入工作队列的内容和用于周期计算的任务
+
+const (
+	MAATQ_SCHEDULE_KEY          = "maatq:schedule"
+	MAATQ_SCHEDULE_ENTRY_PREFIX = "maatq:schedule:entry:"
+	MAATQ_SCHEDULE_META_PREFIX  = "maatq:schedule:meta:"
+
+	// 每次最多执行的任务数量
+	scheduleDispatchLimit = 100
+	// 周期任务执行后先推迟这么久，计算出下一次的时间后再更新，期间进程崩溃时任务会被再次执行而不会丢失
+	scheduleRecurringHold = time.Minute
+	// 使用存储时调度器检查到期任务的间隔
+	scheduleStorePollInterval = time.Second
+)
+
+// ScheduleStore 定时任务的存储
+type ScheduleStore interface {
+	// Add 保存任务，data 是写入工作队列的内容，任务已经存在时覆盖
+	Add(pm *PriorityMessage, data []byte) error
+	// Remove 删除任务，返回任务是否存在
+	Remove(id string) (bool, error)
+	// Get 查找任务，任务不存在时返回 ErrNil
+	Get(id string) (*PriorityMessage, error)
+	// Dispatch 把到期的任务写入工作队列，每次最多执行 scheduleDispatchLimit 个任务
+	Dispatch(now time.Time) (*DispatchResult, error)
+	// Reschedule 更新周期任务下一次执行的时间
+	Reschedule(pm *PriorityMessage) error
+	// List 按到期时间列出所有任务
+	List() ([]*PriorityMessage, error)
+}
+
+// DispatchResult 一次执行到期任务的结果
+type DispatchResult struct {
+	N         int                // 处理的任务数量
+	Oldest    int64              // 最早的到期时间，用于统计延迟
+	Recurring []*PriorityMessage // 需要计算下一次时间的周期任务
+}
+
+var (
+	ErrScheduleStoreNotAtomic = errors.New("durable schedules with scheduler HA require a Redis backend")
+)
+
+// NewScheduleStore 使用 Redis 时通过 Lua 脚本原子地执行到期任务，其他存储后端逐个执行
+// 命名空间和 Redis Streams 的存储后端也使用 Lua 脚本
+func NewScheduleStore(backend Backend) ScheduleStore {
+	s := &backendScheduleStore{backend: backend}
+	if ks, ok := newRedisKeyspace(backend); ok {
+		return &redisScheduleStore{backendScheduleStore: s, keyspace: ks}
+	}
+	return s
+}
+
+// 执行到期任务是否是原子的，多个调度器可以共享
+func isAtomicScheduleStore(store ScheduleStore) bool {
+	_, ok := store.(*redisScheduleStore)
+	return ok
+}
+
+// 工作队列的内容，格式为 队列\n是否周期任务\n消息，便于 Lua 脚本解析
+func encodeScheduleEntry(queue string, recurring bool, data []byte) []byte {
+	flag := "0"
+	if recurring {
+		flag = "1"
+	}
+	b := make([]byte, 0, len(queue)+len(data)+3)
+	b = append(b, queue...)
+	b = append(b, '\n')
+	b = append(b, flag...)
+	b = append(b, '\n')
+	return append(b, data...)
+}
+
+func decodeScheduleEntry(b []byte) (string, bool, []byte, bool) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 || len(b) < i+3 {
+		return "", false, nil, false
+	}
+	return string(b[:i]), b[i+1] == '1', b[i+3:], true
+}
+
+// 使用 Backend 接口实现的存储，执行任务不是原子的，适用于单个进程
+type backendScheduleStore struct {
+	mu      sync.Mutex
+	backend Backend
+}
+
+func (s *backendScheduleStore) add(pm *PriorityMessage, queue string, data []byte) error {
+	meta, err := marshalScheduled(pm)
+	if err != nil {
+		return err
+	}
+	if err := s.backend.Set(MAATQ_SCHEDULE_ENTRY_PREFIX+pm.Id, encodeScheduleEntry(queue, pm.IsPeriodic(), data), 0); err != nil {
+		return err
+	}
+	if err := s.backend.Set(MAATQ_SCHEDULE_META_PREFIX+pm.Id, meta, 0); err != nil {
+		return err
+	}
+	return s.backend.ZAdd(MAATQ_SCHEDULE_KEY, scheduleScore(pm), pm.Id)
+}
+
+// 任务在有序集合中的分数，暂停的任务为正无穷，不会被执行但仍然可以列出
+func scheduleScore(pm *PriorityMessage) float64 {
+	if pm.Paused {
+		return math.Inf(1)
+	}
+	return float64(pm.T)
+}
+
+func (s *backendScheduleStore) Add(pm *PriorityMessage, data []byte) error {
+	return s.add(pm, pm.GetWorkQueue(), data)
+}
+
+func (s *backendScheduleStore) Remove(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.backend.Get(MAATQ_SCHEDULE_META_PREFIX + id); err != nil {
+		if err == ErrNil {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := s.backend.ZRem(MAATQ_SCHEDULE_KEY, id); err != nil {
+		return false, err
+	}
+	return true, s.backend.Del(MAATQ_SCHEDULE_ENTRY_PREFIX+id, MAATQ_SCHEDULE_META_PREFIX+id)
+}
+
+// 到期的任务一起写入工作队列
+func (s *backendScheduleStore) Dispatch(now time.Time) (*DispatchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.backend.ZRangeByScore(MAATQ_SCHEDULE_KEY, math.Inf(-1), float64(now.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > scheduleDispatchLimit {
+		ids = ids[:scheduleDispatchLimit]
+	}
+	rv := &DispatchResult{N: len(ids)}
+	if len(ids) == 0 {
+		return rv, nil
+	}
+	// 任务执行后会被删除，先读取最早的到期时间
+	first, err := s.load(ids[:1])
+	if err != nil {
+		return nil, err
+	}
+	if len(first) > 0 {
+		rv.Oldest = first[0].T
+	}
+
+	var (
+		entries         = make([]QueueEntry, 0, len(ids))
+		once, recurring []string
+	)
+	for _, id := range ids {
+		b, err := s.backend.Get(MAATQ_SCHEDULE_ENTRY_PREFIX + id)
+		if err == ErrNil {
+			s.backend.ZRem(MAATQ_SCHEDULE_KEY, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		queue, periodic, data, ok := decodeScheduleEntry(b)
+		if !ok {
+			s.backend.ZRem(MAATQ_SCHEDULE_KEY, id)
+			continue
+		}
+		entries = append(entries, QueueEntry{Queue: queue, Data: data})
+		if periodic {
+			recurring = append(recurring, id)
+		} else {
+			once = append(once, id)
+		}
+	}
+	if _, err := pushBatch(s.backend, entries); err != nil {
+		return nil, err
+	}
+	for _, id := range recurring {
+		s.backend.ZAdd(MAATQ_SCHEDULE_KEY, float64(now.Add(scheduleRecurringHold).Unix()), id)
+	}
+	for _, id := range once {
+		s.backend.ZRem(MAATQ_SCHEDULE_KEY, id)
+		s.backend.Del(MAATQ_SCHEDULE_ENTRY_PREFIX+id, MAATQ_SCHEDULE_META_PREFIX+id)
+	}
+	rv.Recurring, err = s.load(recurring)
+	return rv, err
+}
+
+func (s *backendScheduleStore) Get(id string) (*PriorityMessage, error) {
+	items, err := s.load([]string{id})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrNil
+	}
+	return items[0], nil
+}
+
+// 读取任务，已经被删除的任务被忽略
+func (s *backendScheduleStore) load(ids []string) ([]*PriorityMessage, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = MAATQ_SCHEDULE_META_PREFIX + id
+	}
+	values, err := s.backend.MGet(keys...)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]*PriorityMessage, 0, len(values))
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		pm, err := unmarshalScheduled(v)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, pm)
+	}
+	return rv, nil
+}
+
+func (s *backendScheduleStore) Reschedule(pm *PriorityMessage) error {
+	meta, err := marshalScheduled(pm)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 任务在执行后被删除时不再恢复
+	if _, err := s.backend.Get(MAATQ_SCHEDULE_ENTRY_PREFIX + pm.Id); err != nil {
+		if err == ErrNil {
+			return nil
+		}
+		return err
+	}
+	if err := s.backend.Set(MAATQ_SCHEDULE_META_PREFIX+pm.Id, meta, 0); err != nil {
+		return err
+	}
+	return s.backend.ZAdd(MAATQ_SCHEDULE_KEY, scheduleScore(pm), pm.Id)
+}
+
+func (s *backendScheduleStore) List() ([]*PriorityMessage, error) {
+	ids, err := s.backend.ZRangeByScore(MAATQ_SCHEDULE_KEY, math.Inf(-1), math.Inf(1))
+	if err != nil {
+		return nil, err
+	}
+	return s.load(ids)
+}
+
+// 使用 Lua 脚本原子地执行到期任务，多个调度器同时执行也不会重复
+type redisScheduleStore struct {
+	*backendScheduleStore
+	keyspace *redisKeyspace
+}
+
+// Redis 中实际的键名，存储后端可能包装了命名空间和 Redis Streams
+type redisKeyspace struct {
+	redis  *RedisBackend
+	prefix string         // NamespacedBackend 的前缀
+	stream *StreamBackend // 不使用 Redis Streams 时为空
+}
+
+// 找到存储后端底层的 RedisBackend，不是 Redis 时返回 false
+func newRedisKeyspace(backend Backend) (*redisKeyspace, bool) {
+	ks := &redisKeyspace{}
+	for {
+		switch b := backend.(type) {
+		case *NamespacedBackend:
+			// 外层的前缀先加上
+			ks.prefix = b.prefix + ks.prefix
+			backend = b.backend
+		case *StreamBackend:
+			ks.redis, ks.stream = b.RedisBackend, b
+			return ks, true
+		case *RedisBackend:
+			ks.redis = b
+			return ks, true
+		default:
+			return nil, false
+		}
+	}
+}
+
+func (ks *redisKeyspace) key(k string) string {
+	return ks.redis.key(ks.prefix + k)
+}
+
+func (ks *redisKeyspace) isStream(queue string) bool {
+	return ks.stream != nil && ks.stream.isStream(ks.prefix+queue)
+}
+
+func (ks *redisKeyspace) streamMaxLen() int64 {
+	if ks.stream == nil {
+		return 0
+	}
+	return ks.stream.options.MaxLen
+}
+
+// 脚本访问的键都通过 KEYS 传入。所有键名都以 maatq: 开头，或者以命名空间开头，
+// 使用 Redis Cluster 时第一段是哈希标签，所以都在同一个哈希槽中
+//
+// KEYS[1] 有序集合，之后每个任务三个键: 工作队列内容的键，任务的键，工作队列
+// ARGV[1] 当前时间，ARGV[2] 周期任务推迟到的时间，ARGV[3] Stream 裁剪的长度，
+// 之后每个任务三个参数: 编号，工作队列名称，工作队列类型 (l: List, s: Stream)
+//
+// 任务已经被其他调度器执行或者工作队列已经改变时跳过，下一次再执行
+var dispatchScript = redis.NewScript(`
+local processed, oldest = 0, nil
+local recurring = {}
+for i = 1, (#KEYS - 1) / 3 do
+	local entryKey, metaKey, queueKey = KEYS[3 * i - 1], KEYS[3 * i], KEYS[3 * i + 1]
+	local id, queue, kind = ARGV[3 * i + 1], ARGV[3 * i + 2], ARGV[3 * i + 3]
+	local score = tonumber(redis.call("ZSCORE", KEYS[1], id) or "")
+	if score and score <= tonumber(ARGV[1]) then
+		local entry = redis.call("GET", entryKey)
+		local j = entry and string.find(entry, "\n", 1, true)
+		if not j then
+			redis.call("ZREM", KEYS[1], id)
+			processed = processed + 1
+		elseif string.sub(entry, 1, j - 1) == queue then
+			local data = string.sub(entry, j + 3)
+			if kind == "s" and ARGV[3] ~= "0" then
+				redis.call("XADD", queueKey, "MAXLEN", "~", ARGV[3], "*", "` + streamDataField + `", data)
+			elseif kind == "s" then
+				redis.call("XADD", queueKey, "*", "` + streamDataField + `", data)
+			else
+				redis.call("RPUSH", queueKey, data)
+			end
+			if string.sub(entry, j + 1, j + 1) == "1" then
+				redis.call("ZADD", KEYS[1], ARGV[2], id)
+				table.insert(recurring, id)
+			else
+				redis.call("ZREM", KEYS[1], id)
+				redis.call("DEL", entryKey, metaKey)
+			end
+			processed = processed + 1
+			if not oldest or score < oldest then
+				oldest = score
+			end
+		end
+	end
+end
+return {processed, recurring, oldest or 0}`)
+
+// KEYS[1] 工作队列内容的键，KEYS[2] 任务的键，KEYS[3] 有序集合，ARGV: 任务，分数，编号
+// 任务已经被删除时不做任何改变
+var rescheduleScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("SET", KEYS[2], ARGV[1])
+redis.call("ZADD", KEYS[3], ARGV[2], ARGV[3])
+return 1`)
+
+func (s *redisScheduleStore) Dispatch(now time.Time) (*DispatchResult, error) {
+	client := s.keyspace.redis.client
+	ids, err := client.ZRangeByScore(s.keyspace.key(MAATQ_SCHEDULE_KEY), redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Unix(), 10),
+		Count: scheduleDispatchLimit,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	rv := &DispatchResult{}
+	if len(ids) == 0 {
+		return rv, nil
+	}
+	entryKeys := make([]string, len(ids))
+	for i, id := range ids {
+		entryKeys[i] = s.keyspace.key(MAATQ_SCHEDULE_ENTRY_PREFIX + id)
+	}
+	entries, err := client.MGet(entryKeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, 1+3*len(ids))
+	keys = append(keys, s.keyspace.key(MAATQ_SCHEDULE_KEY))
+	args := make([]interface{}, 0, 3+3*len(ids))
+	args = append(args, now.Unix(), now.Add(scheduleRecurringHold).Unix(), s.keyspace.streamMaxLen())
+	for i, id := range ids {
+		var queue string
+		if v, ok := entries[i].(string); ok {
+			queue, _, _, _ = decodeScheduleEntry([]byte(v))
+		}
+		// 任务已经被删除时不会写入工作队列，使用同一个哈希槽中的任意一个键
+		queueKey, kind := entryKeys[i], "l"
+		if len(queue) > 0 {
+			queueKey = s.keyspace.key(queue)
+			if s.keyspace.isStream(queue) {
+				kind = "s"
+			}
+		}
+		keys = append(keys, entryKeys[i], s.keyspace.key(MAATQ_SCHEDULE_META_PREFIX+id), queueKey)
+		args = append(args, id, queue, kind)
+	}
+
+	v, err := dispatchScript.Run(client, keys, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	reply, _ := v.([]interface{})
+	if len(reply) < 3 {
+		return rv, nil
+	}
+	n, _ := reply[0].(int64)
+	rv.N = int(n)
+	rv.Oldest, _ = reply[2].(int64)
+	values, _ := reply[1].([]interface{})
+	recurring := make([]string, 0, len(values))
+	for _, id := range values {
+		if s, ok := id.(string); ok {
+			recurring = append(recurring, s)
+		}
+	}
+	rv.Recurring, err = s.load(recurring)
+	return rv, err
+}
+
+func (s *redisScheduleStore) Reschedule(pm *PriorityMessage) error {
+	meta, err := marshalScheduled(pm)
+	if err != nil {
+		return err
+	}
+	keys := []string{
+		s.keyspace.key(MAATQ_SCHEDULE_ENTRY_PREFIX + pm.Id),
+		s.keyspace.key(MAATQ_SCHEDULE_META_PREFIX + pm.Id),
+		s.keyspace.key(MAATQ_SCHEDULE_KEY),
+	}
+	score := "+inf"
+	if !pm.Paused {
+		score = strconv.FormatInt(pm.T, 10)
+	}
+	return rescheduleScript.Run(s.keyspace.redis.client, keys, meta, score, pm.Id).Err()
+}
+
+func (s *Scheduler) addToStore(pm *PriorityMessage) {
+	data, err := marshalMessage(&pm.Message)
+	if err == nil {
+		err = s.store.Add(pm, data)
+	}
+	if err != nil {
+		s.logger.WithFields(pm.ToLogFields()).WithError(err).Error("Add message to store error")
+		return
+	}
+	s.csleep.Cancel()
+}
+
+// 执行存储中到期的任务，并计算周期任务下一次执行的时间
+// 一次执行所有到期的任务，每次调用 Dispatch 最多执行 scheduleDispatchLimit 个
+func (s *Scheduler) tickStore() (time.Duration, error) {
+	now := time.Now()
+	var (
+		n      int
+		oldest int64
+	)
+	for {
+		r, err := s.store.Dispatch(now)
+		if err != nil {
+			s.metrics.fail()
+			s.metrics.record(n, now, oldest)
+			return scheduleStorePollInterval, err
+		}
+		for _, pm := range r.Recurring {
+			pm.T = pm.P.Next().Unix()
+			if err := s.store.Reschedule(pm); err != nil {
+				s.logger.WithFields(pm.ToLogFields()).WithError(err).Error("Reschedule error")
+			}
+		}
+		if n == 0 {
+			oldest = r.Oldest
+		}
+		n += r.N
+		if r.N < scheduleDispatchLimit {
+			break
+		}
+	}
+	if n > 0 {
+		s.logger.Debugf("%d messages dispatched", n)
+	}
+	s.metrics.record(n, now, oldest)
+	return scheduleStorePollInterval, nil
+}
+
+// 恢复保存的任务，使用存储时把任务导入存储
+func (s *Scheduler) restore(h *minHeap) error {
+	if s.store == nil {
+		s.mu.Lock()
+		s.heap = h
+		s.mu.Unlock()
+		return nil
+	}
+	for _, pm := range *h.Items {
+		data, err := marshalMessage(&pm.Message)
+		if err != nil {
+			return err
+		}
+		if err := s.store.Add(pm, data); err != nil {
+			return err
+		}
+	}
+	return s.backend.Del(MAATQ_DUMPS_KEY)
+}
@@ -0,0 +1,160 @@
+package maatq
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleEntry(t *testing.T) {
+	b := encodeScheduleEntry(DefaultQueue, true, []byte("a\nb"))
+	queue, recurring, data, ok := decodeScheduleEntry(b)
+	if !ok || queue != DefaultQueue || !recurring || string(data) != "a\nb" {
+		t.Error("解析工作队列内容错误: ", queue, recurring, string(data))
+	}
+	if _, _, _, ok := decodeScheduleEntry([]byte("broken")); ok {
+		t.Error("格式错误时应该返回 false")
+	}
+}
+
+func TestSchedulerWithStore(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := NewScheduler(backend)
+	s.SetStore(NewScheduleStore(backend))
+
+	s.Delay(&Message{Id: "ID(1)", Event: "hello"}, -time.Second)
+	s.Delay(&Message{Id: "ID(2)", Event: "hello"}, time.Hour)
+	p, _ := NewPeriod(60)
+	s.Period(&Message{Id: "ID(3)", Event: "hello", Queue: "sms"}, p)
+	s.store.Reschedule(&PriorityMessage{Message: Message{Id: "ID(3)", Event: "hello", Queue: "sms"}, T: time.Now().Unix() - 1, P: p})
+
+	if _, err := s.tick(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := backend.Len(DefaultQueue); n != 1 {
+		t.Error("到期的任务应该写入工作队列: ", n)
+	}
+	if n, _ := backend.Len(queueName("sms")); n != 1 {
+		t.Error("到期的周期任务应该写入工作队列: ", n)
+	}
+
+	items, err := s.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[1].Id != "ID(2)" || items[0].T <= time.Now().Unix() {
+		t.Error("周期任务应该重新计算执行时间: ", items)
+	}
+
+	if !s.Cancel("ID(2)") || s.Cancel("ID(2)") {
+		t.Error("取消任务错误")
+	}
+}
+
+func TestSchedulerRestoreToStore(t *testing.T) {
+	backend := NewMemoryBackend()
+	old := NewScheduler(backend)
+	old.Delay(&Message{Id: "ID(1)", Event: "hello"}, time.Hour)
+	if err := old.dumps(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewScheduler(backend)
+	s.SetStore(NewScheduleStore(backend))
+	h, err := s.loads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.restore(h); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := s.store.List(); len(items) != 1 || items[0].Id != "ID(1)" {
+		t.Error("保存的任务应该导入存储: ", items)
+	}
+	if _, err := backend.Get(MAATQ_DUMPS_KEY); err != ErrNil {
+		t.Error("导入后应该删除 dumps")
+	}
+}
+
+func TestScheduleStoreRescheduleCanceled(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewScheduleStore(backend)
+	p, _ := NewPeriod(60)
+	pm := &PriorityMessage{Message: Message{Id: "ID(1)", Event: "hello"}, T: time.Now().Unix() - 1, P: p}
+	store.Add(pm, []byte("{}"))
+
+	r, err := store.Dispatch(time.Now())
+	if err != nil || len(r.Recurring) != 1 {
+		t.Fatal("周期任务应该被执行: ", r, err)
+	}
+	// 执行后计算下一次时间之前任务被取消
+	store.Remove("ID(1)")
+	if err := store.Reschedule(r.Recurring[0]); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := store.List(); len(items) != 0 {
+		t.Error("已经取消的任务不应该被恢复: ", items)
+	}
+}
+
+// 从 Redis 的键名中取出哈希标签
+func hashTag(key string) string {
+	if i := strings.Index(key, "{"); i >= 0 {
+		if j := strings.Index(key[i+1:], "}"); j > 0 {
+			return key[i+1 : i+1+j]
+		}
+	}
+	return key
+}
+
+func TestRedisScheduleStoreKeyspace(t *testing.T) {
+	if isAtomicScheduleStore(NewScheduleStore(NewMemoryBackend())) {
+		t.Error("内存后端不能原子地执行任务")
+	}
+	if _, err := NewBroker(&BrokerOptions{
+		Backend:          NewMemoryBackend(),
+		Queues:           []string{"default"},
+		Scheduler:        true,
+		SchedulerHA:      true,
+		DurableSchedules: true,
+	}); err != ErrScheduleStoreNotAtomic {
+		t.Error("开启选举时持久化的任务需要 Redis: ", err)
+	}
+
+	rb := &RedisBackend{hashTag: true, namespace: "staging:"}
+	streams := NewStreamBackend(rb, &StreamOptions{Queues: []string{"sms"}, MaxLen: 1000})
+	for _, backend := range []Backend{rb, streams, NewNamespacedBackend(streams, "blue")} {
+		store, ok := NewScheduleStore(backend).(*redisScheduleStore)
+		if !ok {
+			t.Fatalf("%T 应该使用 Lua 脚本执行任务", backend)
+		}
+		ks := store.keyspace
+		if ks.redis != rb {
+			t.Errorf("%T 应该使用底层的 RedisBackend", backend)
+		}
+
+		// 脚本访问的所有键在同一个哈希槽中
+		keys := []string{
+			ks.key(MAATQ_SCHEDULE_KEY),
+			ks.key(MAATQ_SCHEDULE_ENTRY_PREFIX + "ID({x})"),
+			ks.key(MAATQ_SCHEDULE_META_PREFIX + "ID({x})"),
+			ks.key(DefaultQueue),
+			ks.key(queueName("sms")),
+			ks.key(tenantQueueName("acme", "{sms}")),
+		}
+		for _, key := range keys {
+			if hashTag(key) != "staging" {
+				t.Errorf("%T 键 %s 不在同一个哈希槽中", backend, key)
+			}
+		}
+	}
+
+	ks, _ := newRedisKeyspace(NewNamespacedBackend(rb, "blue"))
+	if k := ks.key(DefaultQueue); k != "{staging}:blue:maatq:default" {
+		t.Error("命名空间的键名错误: ", k)
+	}
+	ks, _ = newRedisKeyspace(streams)
+	if !ks.isStream(queueName("sms")) || ks.isStream(DefaultQueue) || ks.streamMaxLen() != 1000 {
+		t.Error("Stream 队列错误")
+	}
+}
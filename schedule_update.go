@@ -0,0 +1,200 @@
+package maatq
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrConflictingUpdate = errors.New("only one of period, crontab and once can be set")
+	ErrNotRecurring      = errors.New("schedule is not recurring")
+	ErrAlreadyDispatched = errors.New("schedule is already being dispatched")
+)
+
+// ScheduleUpdate 修改任务，零值的字段保持不变，任务的编号不变
+type ScheduleUpdate struct {
+	At      time.Time     // 下一次执行的时间
+	Delay   time.Duration // 从现在开始延迟执行，At 不为零时忽略
+	Period  *Period       // 改为周期任务
+	Crontab *Crontab      // 改为 Crontab 任务
+	Once    bool          // 改为只执行一次的任务
+	Data    interface{}   // 消息数据
+	Queue   string        // 工作队列
+}
+
+// 修改任务，只修改了周期时按新的周期计算下一次执行的时间
+func (u *ScheduleUpdate) apply(pm *PriorityMessage, now time.Time) error {
+	n := 0
+	for _, set := range []bool{u.Period != nil, u.Crontab != nil, u.Once} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return ErrConflictingUpdate
+	}
+	switch {
+	case u.Period != nil:
+		if u.Period.Cycle <= 0 {
+			return ErrNotPositive
+		}
+		pm.P = u.Period
+	case u.Crontab != nil:
+		pm.P = u.Crontab
+	case u.Once:
+		pm.P = nil
+		pm.Paused = false
+	}
+
+	switch {
+	case !u.At.IsZero():
+		pm.T = u.At.Unix()
+	case u.Delay != 0:
+		pm.T = now.Add(u.Delay).Unix()
+	case n > 0 && pm.IsPeriodic():
+		pm.T = pm.P.Next().Unix()
+	}
+
+	if u.Data != nil {
+		pm.Data = u.Data
+		pm.DataRef, pm.DataPinned, pm.Encoding, pm.KeyId = "", false, "", ""
+		// 新的数据是当前版本，由 Broker.prepare 重新设置
+		pm.Version = 0
+	}
+	if len(u.Queue) > 0 {
+		pm.Queue = u.Queue
+	}
+	// 周期任务的数据会被重复使用，不能在执行后删除
+	if len(pm.DataRef) > 0 {
+		pm.DataPinned = pm.IsPeriodic()
+	}
+	return nil
+}
+
+// Update 修改任务，返回修改后的任务
+// 修改后的消息不会重新编码和签名，需要时通过 Broker.UpdateSchedule 修改
+func (s *Scheduler) Update(id string, u *ScheduleUpdate) (*PriorityMessage, error) {
+	return s.update(id, func(pm *PriorityMessage) error {
+		return u.apply(pm, time.Now())
+	})
+}
+
+// 修改任务，leader 在锁内修改，避免修改的同时任务被执行；
+// 使用存储或者不是 leader 时读取任务后重新添加
+func (s *Scheduler) update(id string, fn func(pm *PriorityMessage) error) (*PriorityMessage, error) {
+	if s.store == nil && s.IsLeader() {
+		s.mu.Lock()
+		pm, dispatching, ok := s.lookup(id)
+		if !ok {
+			s.mu.Unlock()
+			return nil, ErrScheduleNotFound
+		}
+		// 正在写入工作队列的一次性任务已经执行，重新放回堆中会再执行一次
+		if dispatching && !pm.IsPeriodic() {
+			s.mu.Unlock()
+			return nil, ErrAlreadyDispatched
+		}
+		v := *pm
+		if err := fn(&v); err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		// 正在写入工作队列的周期任务这一次已经执行，没有修改执行时间时从下一个周期开始
+		if dispatching && v.IsPeriodic() && v.T == pm.T {
+			v.T = v.P.Next().Unix()
+		}
+		s.push(&v)
+		rv := v
+		s.mu.Unlock()
+		s.csleep.Cancel()
+		return &rv, nil
+	}
+
+	pm, ok := s.Get(id)
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+	if err := fn(pm); err != nil {
+		return nil, err
+	}
+	s.schedule(pm)
+	rv := *pm
+	return &rv, nil
+}
+
+// Pause 暂停周期任务，暂停的任务保留在调度器中但不会被执行
+func (s *Scheduler) Pause(id string) (*PriorityMessage, error) {
+	return s.update(id, func(pm *PriorityMessage) error {
+		if !pm.IsPeriodic() {
+			return ErrNotRecurring
+		}
+		pm.Paused = true
+		return nil
+	})
+}
+
+// Resume 恢复暂停的周期任务，从恢复时的下一个周期开始执行
+func (s *Scheduler) Resume(id string) (*PriorityMessage, error) {
+	return s.update(id, func(pm *PriorityMessage) error {
+		if !pm.IsPeriodic() {
+			return ErrNotRecurring
+		}
+		if pm.Paused {
+			pm.Paused = false
+			pm.T = pm.P.Next().Unix()
+		}
+		return nil
+	})
+}
+
+// Register 按名称添加或者更新周期任务，名称作为任务的编号，重复注册时更新任务而不是添加新的任务
+// 周期没有变化时保留下一次执行的时间和暂停状态，避免每次重启都推迟执行
+func (s *Scheduler) Register(name string, m *Message, p Periodicor) (*PriorityMessage, error) {
+	pm, _, err := s.register(name, m, p)
+	return pm, err
+}
+
+// 返回注册后的任务和被替换的消息，任务不存在时被替换的消息为空
+func (s *Scheduler) register(name string, m *Message, p Periodicor) (*PriorityMessage, *Message, error) {
+	switch p.(type) {
+	case *Period, *Crontab:
+	default:
+		return nil, nil, ErrUnknownRecurrence
+	}
+	msg := *m
+	msg.Id = name
+
+	var old *Message
+	pm, err := s.update(name, func(pm *PriorityMessage) error {
+		v := pm.Message
+		old = &v
+		if !sameRecurrence(pm.P, p) {
+			pm.P = p
+			pm.T = p.Next().Unix()
+		}
+		pm.Message = msg
+		return nil
+	})
+	// 同名的一次性任务正在执行时作为新的任务注册
+	if err != ErrScheduleNotFound && err != ErrAlreadyDispatched {
+		return pm, old, err
+	}
+	s.logger.WithFields(msg.ToLogFields()).Infof("Schedule %s registered", name)
+	pm = &PriorityMessage{Message: msg, T: p.Next().Unix(), P: p}
+	s.schedule(pm)
+	v := *pm
+	return &v, nil, nil
+}
+
+// 比较两个周期是否相同，周期任务只比较间隔，不比较开始时间
+func sameRecurrence(a, b Periodicor) bool {
+	switch x := a.(type) {
+	case *Period:
+		y, ok := b.(*Period)
+		return ok && x.Cycle == y.Cycle
+	case *Crontab:
+		y, ok := b.(*Crontab)
+		return ok && x.Text == y.Text && x.Timezone == y.Timezone
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package maatq
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedulerUpdate(t *testing.T) {
+	s := NewScheduler(NewMemoryBackend())
+	s.Delay(&Message{Id: "ID(1)", Event: "hello", Data: "a"}, time.Hour)
+
+	pm, err := s.Update("ID(1)", &ScheduleUpdate{Delay: time.Minute, Data: "b", Queue: "sms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := pm.T - time.Now().Unix(); d < 59 || d > 60 || pm.Data != "b" || pm.Queue != "sms" {
+		t.Error("修改延迟、数据和队列错误: ", pm)
+	}
+
+	cron, _ := NewCrontab("*/5 * * * *")
+	if pm, _ = s.Update("ID(1)", &ScheduleUpdate{Crontab: cron}); pm.P != cron || pm.T != cron.Next().Unix() {
+		t.Error("改为 Crontab 任务后应该重新计算执行时间: ", pm)
+	}
+	at := time.Now().Add(2 * time.Hour)
+	if pm, _ = s.Update("ID(1)", &ScheduleUpdate{Once: true, At: at}); pm.IsPeriodic() || pm.T != at.Unix() {
+		t.Error("改为只执行一次的任务错误: ", pm)
+	}
+	if s.heap.Len() != 1 {
+		t.Error("修改任务不应该改变任务数量: ", s.heap.Len())
+	}
+
+	if _, err := s.Update("ID(1)", &ScheduleUpdate{Once: true, Crontab: cron}); err != ErrConflictingUpdate {
+		t.Error("同时修改多个周期应该返回错误: ", err)
+	}
+	if _, err := s.Update("ID(2)", &ScheduleUpdate{Delay: time.Minute}); err != ErrScheduleNotFound {
+		t.Error("任务不存在时应该返回错误: ", err)
+	}
+}
+
+func TestBrokerUpdateSchedule(t *testing.T) {
+	signer := &Signer{Producer: "api", KeyId: "k1", Secret: []byte("secret-1")}
+	b := newTestBroker(t, &BrokerOptions{Scheduler: true, Signer: signer})
+	handler := b.newHttpServer()
+	b.Delay(&Message{Id: "ID(1)", Event: "hello", Data: "a"}, time.Hour)
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"data": "b", "queue": "sms", "period": 60}`)
+	handler.ServeHTTP(w, httptest.NewRequest("PATCH", "/v1/schedules/ID(1)", body))
+	if w.Code != http.StatusOK {
+		t.Fatal("修改任务失败: ", w.Code, w.Body.String())
+	}
+	pm, _ := b.scheduler.Get("ID(1)")
+	if pm.Data != "b" || pm.Queue != "sms" || !pm.IsPeriodic() {
+		t.Error("修改后的任务错误: ", pm)
+	}
+	v := NewVerifier()
+	v.Add("api", "k1", []byte("secret-1"))
+	if err := v.Verify(&pm.Message); err != nil {
+		t.Error("修改后的消息应该重新签名: ", err)
+	}
+
+	// 修改数据后消息是当前版本，执行时不应该再迁移
+	b.config.Upcasters = NewUpcasterRegistry()
+	b.config.Upcasters.Register("hello", 1, func(data interface{}) (interface{}, error) {
+		return map[string]interface{}{"text": data}, nil
+	})
+	b.Delay(&Message{Id: "ID(2)", Event: "hello", Data: "a"}, time.Hour)
+	b.config.Upcasters.Register("hello", 2, func(data interface{}) (interface{}, error) {
+		return map[string]interface{}{"text": data, "v": 3}, nil
+	})
+	if _, err := b.UpdateSchedule("ID(2)", &ScheduleUpdate{Data: map[string]interface{}{"text": "b", "v": 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if pm, _ := b.scheduler.Get("ID(2)"); pm.Version != 3 {
+		t.Error("修改数据后应该使用当前版本: ", pm.Version)
+	}
+
+	w = httptest.NewRecorder()
+	body = strings.NewReader(`{"period": 60, "once": true}`)
+	handler.ServeHTTP(w, httptest.NewRequest("PATCH", "/v1/schedules/ID(1)", body))
+	if w.Code != http.StatusBadRequest {
+		t.Error("同时修改多个周期应该返回400: ", w.Code)
+	}
+}
+
+func testSchedulerPause(t *testing.T, backend *MemoryBackend, s *Scheduler) {
+	p, _ := NewPeriod(60)
+	s.schedule(&PriorityMessage{Message: Message{Id: "ID(1)", Event: "hello"}, T: time.Now().Unix() - 1, P: p})
+	s.Delay(&Message{Id: "ID(2)", Event: "hello"}, time.Hour)
+
+	if _, err := s.Pause("ID(2)"); err != ErrNotRecurring {
+		t.Error("只执行一次的任务不能暂停: ", err)
+	}
+	if _, err := s.Pause("ID(1)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.tick(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := backend.Len(DefaultQueue); n != 0 {
+		t.Error("暂停的任务不应该被执行: ", n)
+	}
+	if pm, ok := s.Get("ID(1)"); !ok || !pm.Paused {
+		t.Error("暂停的任务应该保留: ", pm)
+	}
+
+	pm, err := s.Resume("ID(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pm.Paused || pm.T <= time.Now().Unix() {
+		t.Error("恢复后应该从下一个周期开始执行: ", pm)
+	}
+	if v, _ := s.Get("ID(1)"); v.Paused {
+		t.Error("恢复后的任务错误: ", v)
+	}
+}
+
+func TestSchedulerPause(t *testing.T) {
+	backend := NewMemoryBackend()
+	testSchedulerPause(t, backend, NewScheduler(backend))
+}
+
+func TestSchedulerPauseWithStore(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := NewScheduler(backend)
+	s.SetStore(NewScheduleStore(backend))
+	testSchedulerPause(t, backend, s)
+}
+
+func TestSchedulerRegister(t *testing.T) {
+	s := NewScheduler(NewMemoryBackend())
+	p, _ := NewPeriod(60)
+	first, err := s.Register("report", &Message{Event: "report", Data: "a"}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Pause("report")
+
+	// 模拟重启后再次注册，新的周期开始时间不同
+	p2, _ := NewPeriod(60)
+	p2.Begin = p2.Begin.Add(-30 * time.Second)
+	pm, err := s.Register("report", &Message{Event: "report", Data: "b"}, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.heap.Len() != 1 || pm.Id != "report" || pm.Data != "b" {
+		t.Error("重复注册应该更新任务: ", s.heap.Len(), pm)
+	}
+	if pm.T != first.T || !pm.Paused {
+		t.Error("周期没有变化时应该保留执行时间和暂停状态: ", pm)
+	}
+
+	cron, _ := NewCrontab("0 9 * * *")
+	if pm, _ = s.Register("report", &Message{Event: "report"}, cron); pm.P != cron || pm.T != cron.Next().Unix() {
+		t.Error("周期变化时应该重新计算执行时间: ", pm)
+	}
+	if _, err := s.Register("report", &Message{Event: "report"}, nil); err != ErrUnknownRecurrence {
+		t.Error("没有周期时应该返回错误: ", err)
+	}
+}
+
+func TestBrokerRegisterByName(t *testing.T) {
+	b := newTestBroker(t, &BrokerOptions{Scheduler: true})
+	handler := b.newHttpServer()
+	for _, data := range []string{"a", "b"} {
+		w := httptest.NewRecorder()
+		body := strings.NewReader(`{"name": "report", "event": "report", "data": "` + data + `", "crontab": "0 9 * * *"}`)
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/v1/messages/crontab", body))
+		if w.Code != http.StatusOK {
+			t.Fatal("注册任务失败: ", w.Code, w.Body.String())
+		}
+	}
+	pm, ok := b.scheduler.Get("report")
+	if !ok || pm.Data != "b" || b.scheduler.heap.Len() != 1 {
+		t.Error("按名称重复注册应该更新任务: ", pm, b.scheduler.heap.Len())
+	}
+}
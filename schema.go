@@ -0,0 +1,88 @@
+package maatq
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// 使用 JSON Schema 校验消息数据
+
+// FieldError 字段的校验错误
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError 消息数据校验失败
+type ValidationError struct {
+	Event  string
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	s := make([]string, 0, len(e.Errors))
+	for _, f := range e.Errors {
+		s = append(s, fmt.Sprintf("%s: %s", f.Field, f.Message))
+	}
+	return fmt.Sprintf("event[%s] data invalid: %s", e.Event, strings.Join(s, "; "))
+}
+
+// SchemaRegistry 保存每个事件的 JSON Schema，没有注册 Schema 的事件不校验
+type SchemaRegistry struct {
+	mu      sync.RWMutex
+	schemas map[string]*gojsonschema.Schema
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{
+		schemas: make(map[string]*gojsonschema.Schema),
+	}
+}
+
+// Register 注册事件的 JSON Schema，重复注册会替换原来的 Schema
+func (r *SchemaRegistry) Register(event, schema string) error {
+	s, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schema))
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas[event] = s
+	return nil
+}
+
+// Unregister 移除事件的 JSON Schema
+func (r *SchemaRegistry) Unregister(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.schemas, event)
+}
+
+// Validate 校验事件数据，校验失败时返回 *ValidationError
+func (r *SchemaRegistry) Validate(event string, data interface{}) error {
+	r.mu.RLock()
+	s, ok := r.schemas[event]
+	r.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	result, err := s.Validate(gojsonschema.NewGoLoader(data))
+	if err != nil {
+		return err
+	}
+	if result.Valid() {
+		return nil
+	}
+	v := &ValidationError{Event: event}
+	for _, e := range result.Errors() {
+		v.Errors = append(v.Errors, FieldError{
+			Field:   e.Field(),
+			Message: e.Description(),
+		})
+	}
+	return v
+}
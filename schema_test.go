@@ -0,0 +1,48 @@
+package maatq
+
+import (
+	"testing"
+)
+
+func TestSchemaRegistry(t *testing.T) {
+	r := NewSchemaRegistry()
+	if err := r.Register("sms.send", "{"); err == nil {
+		t.Error("非法的 Schema 应该返回错误")
+	}
+	err := r.Register("sms.send", `{
+		"type": "object",
+		"properties": {
+			"phone": {"type": "string", "pattern": "^[0-9]{11}$"},
+			"text": {"type": "string"}
+		},
+		"required": ["phone", "text"]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Validate("sms.send", map[string]interface{}{"phone": "13800000000", "text": "hi"}); err != nil {
+		t.Error("合法的数据校验失败: ", err)
+	}
+	if err := r.Validate("hello", "world"); err != nil {
+		t.Error("没有 Schema 的事件不应该校验: ", err)
+	}
+
+	err = r.Validate("sms.send", map[string]interface{}{"phone": "138"})
+	v, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatal("非法的数据应该返回 *ValidationError: ", err)
+	}
+	fields := make(map[string]bool)
+	for _, f := range v.Errors {
+		fields[f.Field] = true
+	}
+	if !fields["phone"] || !fields["(root)"] {
+		t.Error("字段错误不完整: ", v.Errors)
+	}
+
+	status, resp := newWriteErrorResponse(err)
+	if status != 400 || len(resp.Errors) != len(v.Errors) {
+		t.Error("校验失败应该返回400: ", status)
+	}
+}
@@ -0,0 +1,165 @@
+package maatq
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// 消息签名，用于验证消息的生产者
+// 签名覆盖消息中不会被 Worker 修改的字段，重试时修改 try 和 timestamp 不影响签名
+
+var (
+	DefaultQuarantineQueue = "maatq:quarantine"
+
+	ErrUnsigned         = errors.New("message unsigned")
+	ErrUnknownProducer  = errors.New("unknown message producer")
+	ErrUnknownSignKey   = errors.New("unknown message sign key")
+	ErrInvalidSignature = errors.New("invalid message signature")
+)
+
+// Signer 生产者签名使用的密钥
+type Signer struct {
+	Producer string
+	KeyId    string
+	Secret   []byte
+}
+
+// 签名的消息字段
+type signedEnvelope struct {
+	Id         string          `json:"id"`
+	Event      string          `json:"event"`
+	Data       json.RawMessage `json:"data"`
+	Queue      string          `json:"queue"`
+	DataRef    string          `json:"data_ref"`
+	DataPinned bool            `json:"data_pinned"`
+	Encoding   string          `json:"encoding"`
+	KeyId      string          `json:"key_id"`
+	Producer   string          `json:"producer"`
+	SigKey     string          `json:"sig_key"`
+	Version    int             `json:"version"`
+	Tenant     string          `json:"tenant,omitempty"`
+	Tags       []string        `json:"tags,omitempty"`
+}
+
+// 生成规范化的签名内容
+// 消息数据先经过一次 JSON 解码，和 Worker 读取消息时一样得到 map 和 float64，
+// 保证生产者和 Worker 得到相同的字节
+func canonicalEnvelope(m *Message) ([]byte, error) {
+	data, err := json.Marshal(m.Data)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&signedEnvelope{
+		Id:         m.Id,
+		Event:      m.Event,
+		Data:       data,
+		Queue:      m.Queue,
+		DataRef:    m.DataRef,
+		DataPinned: m.DataPinned,
+		Encoding:   m.Encoding,
+		KeyId:      m.KeyId,
+		Producer:   m.Producer,
+		SigKey:     m.SigKey,
+		Version:    m.Version,
+		Tenant:     m.Tenant,
+		Tags:       m.Tags,
+	})
+}
+
+func hmacSum(secret, b []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// Sign 对消息签名
+func (s *Signer) Sign(m *Message) error {
+	m.Producer = s.Producer
+	m.SigKey = s.KeyId
+	b, err := canonicalEnvelope(m)
+	if err != nil {
+		return err
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(hmacSum(s.Secret, b))
+	return nil
+}
+
+// Verifier 保存每个生产者的签名密钥，一个生产者可以有多个密钥
+type Verifier struct {
+	mu   sync.RWMutex
+	keys map[string]map[string][]byte
+}
+
+func NewVerifier() *Verifier {
+	return &Verifier{
+		keys: make(map[string]map[string][]byte),
+	}
+}
+
+// Add 添加生产者的密钥
+func (v *Verifier) Add(producer, keyId string, secret []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.keys[producer]; !ok {
+		v.keys[producer] = make(map[string][]byte)
+	}
+	v.keys[producer][keyId] = secret
+}
+
+// Remove 移除生产者的密钥
+func (v *Verifier) Remove(producer, keyId string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.keys[producer], keyId)
+	if len(v.keys[producer]) == 0 {
+		delete(v.keys, producer)
+	}
+}
+
+func (v *Verifier) secret(producer, keyId string) ([]byte, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys, ok := v.keys[producer]
+	if !ok {
+		return nil, ErrUnknownProducer
+	}
+	secret, ok := keys[keyId]
+	if !ok {
+		return nil, ErrUnknownSignKey
+	}
+	return secret, nil
+}
+
+// Verify 验证消息签名
+func (v *Verifier) Verify(m *Message) error {
+	if len(m.Signature) == 0 {
+		return ErrUnsigned
+	}
+	secret, err := v.secret(m.Producer, m.SigKey)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	b, err := canonicalEnvelope(m)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sig, hmacSum(secret, b)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package maatq
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	type payload struct {
+		Phone string `json:"phone"`
+		Count int64  `json:"count"`
+	}
+	s := &Signer{Producer: "api", KeyId: "k2", Secret: []byte("secret-2")}
+	m := &Message{Id: "ID(1)", Event: "sms.send", Data: &payload{"13800000000", 1 << 60}}
+	if err := s.Sign(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟 Worker 从队列中读取消息
+	b, _ := json.Marshal(m)
+	var received Message
+	json.Unmarshal(b, &received)
+	received.Try = 2
+
+	v := NewVerifier()
+	v.Add("api", "k1", []byte("secret-1"))
+	v.Add("api", "k2", []byte("secret-2"))
+	if err := v.Verify(&received); err != nil {
+		t.Error("签名验证失败: ", err)
+	}
+
+	tampered := received
+	tampered.Queue = "admin"
+	if err := v.Verify(&tampered); err != ErrInvalidSignature {
+		t.Error("被修改的消息应该验证失败: ", err)
+	}
+
+	if err := v.Verify(&Message{Id: "ID(2)", Event: "sms.send"}); err != ErrUnsigned {
+		t.Error("未签名的消息应该验证失败: ", err)
+	}
+
+	v.Remove("api", "k2")
+	if err := v.Verify(&received); err != ErrUnknownSignKey {
+		t.Error("移除密钥后应该验证失败: ", err)
+	}
+	v.Remove("api", "k1")
+	if err := v.Verify(&received); err != ErrUnknownProducer {
+		t.Error("未知的生产者应该验证失败: ", err)
+	}
+}
@@ -0,0 +1,465 @@
+package maatq
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+)
+
+// 使用 Redis Streams 的队列，消息处理完成后需要确认
+// 写入时 XADD，读取时 XREADGROUP，处理完成后 XACK，
+// 长时间没有确认的消息会被 XAUTOCLAIM 重新认领
+
+const (
+	DefaultStreamGroup     = "maatq"
+	DefaultStreamClaimIdle = 5 * time.Minute
+
+	streamDataField    = "data"
+	streamPollInterval = 50 * time.Millisecond
+)
+
+// Acker 需要确认消息的存储后端，Worker 处理完成后调用 Ack
+type Acker interface {
+	// PopWithAck 和 Backend.Pop 相同，另外返回用于确认的编号，编号为空时不需要确认
+	PopWithAck(timeout time.Duration, queues ...string) (string, []byte, string, error)
+	Ack(queue, id string) error
+}
+
+// StreamOptions 使用 Redis Streams 的队列配置
+type StreamOptions struct {
+	// 使用 Stream 的队列，租户的同名队列也使用 Stream。同时消费 List 和 Stream 队列时不能阻塞等待，
+	// 每 50ms 轮询一次所有队列，空闲时每个 Worker 每秒对每个队列约 20 次请求，消息最多延迟 50ms
+	Queues    []string
+	Group     string        // 消费组，为空时使用 DefaultStreamGroup
+	Consumer  string        // 消费者名称，为空时使用主机名和进程号
+	MaxLen    int64         // 写入时近似裁剪到的长度，为0时不裁剪，裁剪可能删除未确认的消息
+	ClaimIdle time.Duration // 超过这个时间没有确认的消息会被重新认领，为0时使用 DefaultStreamClaimIdle
+}
+
+type streamEntry struct {
+	queue string
+	id    string
+	data  []byte
+}
+
+// StreamBackend 在 RedisBackend 的基础上，把部分队列换成 Redis Streams
+type StreamBackend struct {
+	*RedisBackend
+	options *StreamOptions
+	streams map[string]bool
+
+	mu        sync.Mutex
+	groups    map[string]bool
+	lastClaim map[string]time.Time
+	pending   []streamEntry
+}
+
+func NewStreamBackend(backend *RedisBackend, opt *StreamOptions) *StreamBackend {
+	if len(opt.Group) == 0 {
+		opt.Group = DefaultStreamGroup
+	}
+	if len(opt.Consumer) == 0 {
+		opt.Consumer = fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	}
+	if opt.ClaimIdle <= 0 {
+		opt.ClaimIdle = DefaultStreamClaimIdle
+	}
+	b := &StreamBackend{
+		RedisBackend: backend,
+		options:      opt,
+		streams:      make(map[string]bool),
+		groups:       make(map[string]bool),
+		lastClaim:    make(map[string]time.Time),
+	}
+	for _, q := range opt.Queues {
+		b.streams[queueName(q)] = true
+	}
+	return b
+}
+
+// 租户的队列和同名的队列使用相同的类型，例如 maatq:tenant:acme:sms 和 maatq:sms
+func (b *StreamBackend) isStream(queue string) bool {
+	return b.streams[untenantKey(queue)]
+}
+
+// 创建消费组，消费组已经存在时忽略错误
+func (b *StreamBackend) ensureGroup(stream string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.groups[stream] {
+		return nil
+	}
+	err := b.client.XGroupCreateMkStream(b.key(stream), b.options.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	b.groups[stream] = true
+	return nil
+}
+
+func (b *StreamBackend) Push(queue string, data []byte) error {
+	if !b.isStream(queue) {
+		return b.RedisBackend.Push(queue, data)
+	}
+	return b.client.XAdd(&redis.XAddArgs{
+		Stream:       b.key(queue),
+		MaxLenApprox: b.options.MaxLen,
+		Values:       map[string]interface{}{streamDataField: data},
+	}).Err()
+}
+
+func (b *StreamBackend) PushBatch(entries []QueueEntry) error {
+	_, err := b.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, e := range entries {
+			if !b.isStream(e.Queue) {
+				pipe.RPush(b.key(e.Queue), e.Data)
+				continue
+			}
+			pipe.XAdd(&redis.XAddArgs{
+				Stream:       b.key(e.Queue),
+				MaxLenApprox: b.options.MaxLen,
+				Values:       map[string]interface{}{streamDataField: e.Data},
+			})
+		}
+		return nil
+	})
+	return err
+}
+
+// PushFront Stream 没有头部，消息追加到尾部
+func (b *StreamBackend) PushFront(queue string, data []byte) error {
+	if !b.isStream(queue) {
+		return b.RedisBackend.PushFront(queue, data)
+	}
+	return b.Push(queue, data)
+}
+
+// Pop 取出 Stream 中的消息后立即确认
+func (b *StreamBackend) Pop(timeout time.Duration, queues ...string) (string, []byte, error) {
+	queue, data, id, err := b.PopWithAck(timeout, queues...)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(id) > 0 {
+		if err := b.Ack(queue, id); err != nil {
+			return "", nil, err
+		}
+	}
+	return queue, data, nil
+}
+
+func (b *StreamBackend) PopWithAck(timeout time.Duration, queues ...string) (string, []byte, string, error) {
+	var lists, streams []string
+	for _, q := range queues {
+		if b.isStream(q) {
+			streams = append(streams, q)
+		} else {
+			lists = append(lists, q)
+		}
+	}
+	if len(streams) == 0 {
+		queue, data, err := b.RedisBackend.Pop(timeout, lists...)
+		return queue, data, "", err
+	}
+
+	for _, s := range streams {
+		if err := b.ensureGroup(s); err != nil {
+			return "", nil, "", err
+		}
+	}
+	if e, ok := b.takePending(streams); ok {
+		return e.queue, e.data, e.id, nil
+	}
+	for _, s := range streams {
+		e, ok, err := b.claim(s)
+		if err != nil {
+			return "", nil, "", err
+		}
+		if ok {
+			return e.queue, e.data, e.id, nil
+		}
+	}
+
+	if len(lists) == 0 {
+		return b.readGroup(timeout, streams)
+	}
+
+	// 同时包含 List 和 Stream 时没有可以同时阻塞等待两种队列的命令，按队列顺序轮询，
+	// 轮询间隔为 streamPollInterval
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, q := range queues {
+			if b.isStream(q) {
+				queue, data, id, err := b.readGroup(-1, []string{q})
+				if err != ErrNil {
+					return queue, data, id, err
+				}
+				continue
+			}
+			data, err := b.client.LPop(b.key(q)).Bytes()
+			if err == nil {
+				return q, data, "", nil
+			}
+			if err != redis.Nil {
+				return "", nil, "", err
+			}
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			return "", nil, "", ErrNil
+		}
+		time.Sleep(streamPollInterval)
+	}
+}
+
+// 从消费组读取新消息，block 小于0时不等待
+// 一次可能从多个 Stream 读到消息，多余的消息留到下次返回
+func (b *StreamBackend) readGroup(block time.Duration, streams []string) (string, []byte, string, error) {
+	args := make([]string, 0, 2*len(streams))
+	args = append(args, b.keys(streams)...)
+	for range streams {
+		args = append(args, ">")
+	}
+	result, err := b.client.XReadGroup(&redis.XReadGroupArgs{
+		Group:    b.options.Group,
+		Consumer: b.options.Consumer,
+		Streams:  args,
+		Count:    1,
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return "", nil, "", ErrNil
+	}
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	b.mu.Lock()
+	for _, s := range result {
+		for _, m := range s.Messages {
+			b.pending = append(b.pending, streamEntry{b.unkey(s.Stream), m.ID, streamData(m.Values)})
+		}
+	}
+	b.mu.Unlock()
+
+	if e, ok := b.takePending(streams); ok {
+		return e.queue, e.data, e.id, nil
+	}
+	return "", nil, "", ErrNil
+}
+
+// 按队列顺序取出已经读到但还没有返回的消息
+func (b *StreamBackend) takePending(streams []string) (streamEntry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range streams {
+		for i, e := range b.pending {
+			if e.queue == s {
+				b.pending = append(b.pending[:i], b.pending[i+1:]...)
+				return e, true
+			}
+		}
+	}
+	return streamEntry{}, false
+}
+
+// 认领一条超时没有确认的消息，每个 Stream 每 ClaimIdle/10 最多检查一次
+func (b *StreamBackend) claim(stream string) (streamEntry, bool, error) {
+	b.mu.Lock()
+	if time.Since(b.lastClaim[stream]) < b.options.ClaimIdle/10 {
+		b.mu.Unlock()
+		return streamEntry{}, false, nil
+	}
+	b.lastClaim[stream] = time.Now()
+	b.mu.Unlock()
+
+	cmd := redis.NewCmd("xautoclaim", b.key(stream), b.options.Group, b.options.Consumer,
+		int64(b.options.ClaimIdle/time.Millisecond), "0-0", "count", 1)
+	b.client.Process(cmd)
+	v, err := cmd.Result()
+	if err != nil {
+		return streamEntry{}, false, err
+	}
+	// 返回值: [下一次的起始编号, [[编号, [字段, 值, ...]], ...], ...]
+	reply, ok := v.([]interface{})
+	if !ok || len(reply) < 2 {
+		return streamEntry{}, false, nil
+	}
+	entries, _ := reply[1].([]interface{})
+	for _, entry := range entries {
+		fields, ok := entry.([]interface{})
+		if !ok || len(fields) < 2 {
+			continue
+		}
+		id, _ := fields[0].(string)
+		values, _ := fields[1].([]interface{})
+		for i := 0; i+1 < len(values); i += 2 {
+			if values[i] == streamDataField {
+				s, _ := values[i+1].(string)
+				log.WithField("stream", stream).Warnf("Claimed idle message %s", id)
+				return streamEntry{stream, id, []byte(s)}, true, nil
+			}
+		}
+	}
+	return streamEntry{}, false, nil
+}
+
+func streamData(values map[string]interface{}) []byte {
+	s, _ := values[streamDataField].(string)
+	return []byte(s)
+}
+
+func (b *StreamBackend) Ack(queue, id string) error {
+	return b.client.XAck(b.key(queue), b.options.Group, id).Err()
+}
+
+// Len Stream 队列返回积压的消息数量，即已经读取但没有确认的消息和还没有读取的消息
+func (b *StreamBackend) Len(queue string) (int64, error) {
+	if !b.isStream(queue) {
+		return b.RedisBackend.Len(queue)
+	}
+	info, ok, err := b.groupInfo(queue)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		// 还没有消费组，所有消息都没有读取
+		return b.client.XLen(b.key(queue)).Result()
+	}
+	if info.hasLag {
+		return info.pending + info.lag, nil
+	}
+	// Redis 7 之前没有 lag，统计最后读取的消息之后的消息
+	messages, err := b.client.XRange(b.key(queue), info.lastDelivered, "+").Result()
+	if err != nil {
+		return 0, err
+	}
+	n := info.pending
+	for _, m := range messages {
+		if m.ID != info.lastDelivered {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Range Stream 队列返回积压的消息，不包括已经确认的消息
+func (b *StreamBackend) Range(queue string, start, stop int64) ([][]byte, error) {
+	if !b.isStream(queue) {
+		return b.RedisBackend.Range(queue, start, stop)
+	}
+	info, ok, err := b.groupInfo(queue)
+	if err != nil {
+		return nil, err
+	}
+	from := "-"
+	pending := make(map[string]bool)
+	if ok {
+		from = info.lastDelivered
+		if info.pending > 0 {
+			entries, err := b.client.XPendingExt(&redis.XPendingExtArgs{
+				Stream: b.key(queue),
+				Group:  b.options.Group,
+				Start:  "-",
+				End:    "+",
+				Count:  info.pending,
+			}).Result()
+			if err != nil {
+				return nil, err
+			}
+			for i, e := range entries {
+				if i == 0 {
+					from = e.Id
+				}
+				pending[e.Id] = true
+			}
+		}
+	}
+	messages, err := b.client.XRange(b.key(queue), from, "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, 0, len(messages))
+	for _, m := range messages {
+		if !ok || pending[m.ID] || streamIdLess(info.lastDelivered, m.ID) {
+			values = append(values, streamData(m.Values))
+		}
+	}
+	start, end, inRange := clampRange(int64(len(values)), start, stop)
+	if !inRange {
+		return [][]byte{}, nil
+	}
+	return values[start:end], nil
+}
+
+// 消费组的状态
+type streamGroupInfo struct {
+	pending       int64  // 已经读取但没有确认的消息数量
+	lastDelivered string // 最后读取的消息编号
+	lag           int64  // 还没有读取的消息数量，Redis 7 之后才有
+	hasLag        bool
+}
+
+// 查询消费组的状态，Stream 或者消费组不存在时返回 false
+func (b *StreamBackend) groupInfo(queue string) (*streamGroupInfo, bool, error) {
+	cmd := redis.NewCmd("xinfo", "groups", b.key(queue))
+	b.client.Process(cmd)
+	v, err := cmd.Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	info, ok := parseStreamGroups(v, b.options.Group)
+	return info, ok, nil
+}
+
+// 解析 XINFO GROUPS 的返回值: [[name, 名称, pending, 数量, last-delivered-id, 编号, lag, 数量, ...], ...]
+func parseStreamGroups(v interface{}, group string) (*streamGroupInfo, bool) {
+	groups, _ := v.([]interface{})
+	for _, g := range groups {
+		fields, _ := g.([]interface{})
+		info := &streamGroupInfo{lastDelivered: "0-0"}
+		name := ""
+		for i := 0; i+1 < len(fields); i += 2 {
+			key, _ := fields[i].(string)
+			switch key {
+			case "name":
+				name, _ = fields[i+1].(string)
+			case "pending":
+				info.pending, _ = fields[i+1].(int64)
+			case "last-delivered-id":
+				info.lastDelivered, _ = fields[i+1].(string)
+			case "lag":
+				info.lag, info.hasLag = fields[i+1].(int64)
+			}
+		}
+		if name == group {
+			return info, true
+		}
+	}
+	return nil, false
+}
+
+// 比较两个 Stream 消息编号，编号的格式为 毫秒-序号
+func streamIdLess(a, b string) bool {
+	am, as := parseStreamId(a)
+	bm, bs := parseStreamId(b)
+	return am < bm || (am == bm && as < bs)
+}
+
+func parseStreamId(id string) (uint64, uint64) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, _ := strconv.ParseUint(parts[0], 10, 64)
+	var seq uint64
+	if len(parts) == 2 {
+		seq, _ = strconv.ParseUint(parts[1], 10, 64)
+	}
+	return ms, seq
+}
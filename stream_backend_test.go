@@ -0,0 +1,94 @@
+package maatq
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 在内存后端上模拟需要确认的队列
+type ackMemoryBackend struct {
+	*MemoryBackend
+	seq   int
+	acked []string
+}
+
+func (b *ackMemoryBackend) PopWithAck(timeout time.Duration, queues ...string) (string, []byte, string, error) {
+	queue, data, err := b.MemoryBackend.Pop(timeout, queues...)
+	if err != nil {
+		return "", nil, "", err
+	}
+	b.seq++
+	return queue, data, strconv.Itoa(b.seq), nil
+}
+
+func (b *ackMemoryBackend) Ack(queue, id string) error {
+	b.acked = append(b.acked, queue+"/"+id)
+	return nil
+}
+
+func TestWorkerAck(t *testing.T) {
+	backend := &ackMemoryBackend{MemoryBackend: NewMemoryBackend()}
+	b, err := NewBroker(&BrokerOptions{Backend: backend, Parallel: 1, Try: 1, Queues: []string{"default"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.AddEventHandler("hello", func(arg interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	b.Enqueue(DefaultQueue, &Message{Id: "ID(1)", Event: "hello"})
+	backend.Push(DefaultQueue, []byte("not a message"))
+
+	if n := b.Drain(); n != 2 {
+		t.Error("处理的消息数量错误: ", n)
+	}
+	// 格式错误的消息也需要确认，否则会被反复认领
+	if len(backend.acked) != 2 || backend.acked[0] != DefaultQueue+"/1" {
+		t.Error("确认的消息错误: ", backend.acked)
+	}
+}
+
+func TestStreamBackendTakePending(t *testing.T) {
+	b := NewStreamBackend(&RedisBackend{}, &StreamOptions{Queues: []string{"q1", "q2"}})
+	if !b.isStream(queueName("q1")) || b.isStream(queueName("q3")) {
+		t.Error("Stream 队列错误")
+	}
+	if !b.isStream(tenantQueueName("acme", "q1")) || b.isStream(tenantQueueName("acme", "q3")) {
+		t.Error("租户的队列应该和同名的队列使用相同的类型")
+	}
+	b.pending = []streamEntry{{"s2", "1-0", nil}, {"s1", "2-0", nil}, {"s2", "3-0", nil}}
+
+	// 按队列顺序返回，同一个队列中按读取顺序返回
+	for _, expected := range []string{"2-0", "1-0", "3-0"} {
+		e, ok := b.takePending([]string{"s1", "s2"})
+		if !ok || e.id != expected {
+			t.Error("返回的消息错误: ", e.id, expected)
+		}
+	}
+	if _, ok := b.takePending([]string{"s1", "s2"}); ok {
+		t.Error("没有消息时应该返回 false")
+	}
+}
+
+func TestStreamGroupInfo(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{"name", "other", "consumers", int64(1), "pending", int64(9), "last-delivered-id", "9-0"},
+		[]interface{}{"name", "maatq", "consumers", int64(2), "pending", int64(3), "last-delivered-id", "5-1", "entries-read", int64(8), "lag", int64(4)},
+	}
+	info, ok := parseStreamGroups(reply, "maatq")
+	if !ok || info.pending != 3 || info.lastDelivered != "5-1" || !info.hasLag || info.lag != 4 {
+		t.Error("解析消费组状态错误: ", info)
+	}
+	if _, ok := parseStreamGroups(reply, "missing"); ok {
+		t.Error("消费组不存在时应该返回 false")
+	}
+	// Redis 7 之前没有 lag
+	info, _ = parseStreamGroups([]interface{}{[]interface{}{"name", "maatq", "pending", int64(0), "last-delivered-id", "1-0"}}, "maatq")
+	if info.hasLag {
+		t.Error("没有 lag 字段时 hasLag 应该为 false")
+	}
+
+	if !streamIdLess("5-1", "5-2") || !streamIdLess("5-9", "10-0") || streamIdLess("10-0", "9-99") || streamIdLess("1-0", "1-0") {
+		t.Error("比较消息编号错误")
+	}
+}
@@ -0,0 +1,121 @@
+package maatq
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 没有找到事件处理函数时的处理策略
+
+type UnhandledAction int
+
+const (
+	UnhandledDrop       UnhandledAction = iota // 记录日志后丢弃，默认行为
+	UnhandledRequeue                           // 延迟后通过调度器重新放回原队列，需要开启调度器
+	UnhandledMove                              // 移动到专门的未处理队列
+	UnhandledDeadLetter                        // 移动到失败队列
+	UnhandledFallback                          // 调用兜底的处理函数
+)
+
+var (
+	DefaultUnhandledQueue        = "maatq:unhandled"
+	DefaultUnhandledRequeueDelay = 5 * time.Second
+	DefaultUnhandledMaxAttempts  = 10
+
+	ErrNoFallbackHandler       = errors.New("fallback handler required")
+	ErrRequeueWithoutScheduler = errors.New("unhandled requeue requires scheduler")
+)
+
+func (a UnhandledAction) String() string {
+	switch a {
+	case UnhandledDrop:
+		return "drop"
+	case UnhandledRequeue:
+		return "requeue"
+	case UnhandledMove:
+		return "move"
+	case UnhandledDeadLetter:
+		return "dead-letter"
+	case UnhandledFallback:
+		return "fallback"
+	}
+	return "unknown"
+}
+
+// UnhandledPolicy 一个Worker组对没有处理函数的消息的处理策略
+type UnhandledPolicy struct {
+	Action UnhandledAction
+	// UnhandledRequeue 时重新入队前等待的时间，为0时使用 DefaultUnhandledRequeueDelay
+	Delay time.Duration
+	// UnhandledRequeue 时最多重新入队的次数，超过后移入失败队列，为0时使用 DefaultUnhandledMaxAttempts
+	// 重新入队的次数记录在消息的 Try 中
+	MaxAttempts int
+	// UnhandledMove 时的目标队列，为空时使用 DefaultUnhandledQueue
+	Queue string
+	// UnhandledFallback 时调用的处理函数，参数为完整的 *Message
+	Fallback EventHandler
+}
+
+func (p *UnhandledPolicy) check() error {
+	if p.Action == UnhandledFallback && p.Fallback == nil {
+		return ErrNoFallbackHandler
+	}
+	return nil
+}
+
+func (p *UnhandledPolicy) requeueDelay() time.Duration {
+	if p.Delay <= 0 {
+		return DefaultUnhandledRequeueDelay
+	}
+	return p.Delay
+}
+
+func (p *UnhandledPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return DefaultUnhandledMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *UnhandledPolicy) moveQueue() string {
+	if len(p.Queue) == 0 {
+		return DefaultUnhandledQueue
+	}
+	return queueName(p.Queue)
+}
+
+// 判断事件名称是否是通配模式，例如 user.*
+func isEventPattern(event string) bool {
+	return strings.ContainsAny(event, "*?[")
+}
+
+// 模式中非通配的字符越多越具体，优先匹配
+func patternSpecificity(pattern string) int {
+	n := 0
+	for _, c := range pattern {
+		if !strings.ContainsRune("*?[]", c) {
+			n++
+		}
+	}
+	return n
+}
+
+// 按具体程度从高到低排序事件模式
+func sortEventPatterns(patterns []string) {
+	sort.SliceStable(patterns, func(i, j int) bool {
+		return patternSpecificity(patterns[i]) > patternSpecificity(patterns[j])
+	})
+}
+
+// 返回第一个匹配事件的模式
+func matchEventPattern(patterns []string, event string) (string, bool) {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, event); ok {
+			return p, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,84 @@
+package maatq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkerEventPatterns(t *testing.T) {
+	w := &Worker{eventHandlers: make(map[string]EventHandler)}
+	handler := func(name string) EventHandler {
+		return func(arg interface{}) (interface{}, error) {
+			return name, nil
+		}
+	}
+	w.AddEventHandler("user.created", handler("exact"))
+	w.AddEventHandler("*", handler("all"))
+	w.AddEventHandler("user.*", handler("user"))
+
+	if err := w.AddEventHandler("user.[", handler("bad")); err == nil {
+		t.Error("非法的模式应该返回错误")
+	}
+
+	cases := map[string]string{
+		"user.created": "exact",
+		"user.deleted": "user",
+		"order":        "all",
+	}
+	for event, expected := range cases {
+		h, ok := w.getEventHandler(event)
+		if !ok {
+			t.Errorf("事件[%s]应该有处理函数", event)
+			continue
+		}
+		if v, _ := h.Call(nil); v != expected {
+			t.Errorf("事件[%s]处理函数错误: expected[%s] got[%v]", event, expected, v)
+		}
+	}
+
+	w.RemoveEventHandler("*")
+	if _, ok := w.getEventHandler("order"); ok {
+		t.Error("移除通配模式后不应该再匹配")
+	}
+}
+
+func TestUnhandledPolicyCheck(t *testing.T) {
+	p := UnhandledPolicy{Action: UnhandledFallback}
+	if err := p.check(); err != ErrNoFallbackHandler {
+		t.Error("Fallback 策略需要处理函数")
+	}
+	p = UnhandledPolicy{Action: UnhandledMove, Queue: "lost"}
+	if q := p.moveQueue(); q != "maatq:lost" {
+		t.Error("未处理队列名称错误: ", q)
+	}
+}
+
+func TestUnhandledRequeue(t *testing.T) {
+	if _, err := NewBroker(&BrokerOptions{
+		Backend:   NewMemoryBackend(),
+		Unhandled: UnhandledPolicy{Action: UnhandledRequeue},
+	}); err != ErrRequeueWithoutScheduler {
+		t.Error("没有开启调度器时不能使用 UnhandledRequeue: ", err)
+	}
+
+	b := newTestBroker(t, &BrokerOptions{
+		Scheduler: true,
+		Unhandled: UnhandledPolicy{Action: UnhandledRequeue, Delay: time.Minute, MaxAttempts: 2},
+	})
+	b.Enqueue(DefaultQueue, &Message{Id: "ID(1)", Event: "unknown"})
+	b.Drain()
+	pm, ok := b.scheduler.Get("ID(1)")
+	if !ok || pm.Try != 1 {
+		t.Fatal("消息应该通过调度器重新入队: ", pm)
+	}
+
+	// 超过最大次数后移入失败队列
+	b.Enqueue(DefaultQueue, &Message{Id: "ID(2)", Event: "unknown", Try: 2})
+	b.Drain()
+	if _, ok := b.scheduler.Get("ID(2)"); ok {
+		t.Error("超过最大次数后不应该重新入队")
+	}
+	if n, _ := b.backend.Len(DefaultFailedQueue); n != 1 {
+		t.Error("超过最大次数后应该移入失败队列: ", n)
+	}
+}
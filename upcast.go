@@ -0,0 +1,79 @@
+package maatq
+
+import (
+	"fmt"
+	"sync"
+)
+
+// 消息数据的版本迁移
+// 事件的数据结构变化时，为旧版本注册迁移函数，Worker 在调用处理函数前把数据迁移到当前版本
+
+// Upcaster 把数据从一个版本迁移到下一个版本
+type Upcaster func(data interface{}) (interface{}, error)
+
+// UpcasterRegistry 保存每个事件的迁移函数
+// 没有版本号的消息视为版本1，事件的当前版本是最大的迁移起始版本加1
+type UpcasterRegistry struct {
+	mu        sync.RWMutex
+	upcasters map[string]map[int]Upcaster
+	versions  map[string]int
+}
+
+func NewUpcasterRegistry() *UpcasterRegistry {
+	return &UpcasterRegistry{
+		upcasters: make(map[string]map[int]Upcaster),
+		versions:  make(map[string]int),
+	}
+}
+
+// Register 注册事件从 from 版本迁移到 from+1 版本的函数
+func (r *UpcasterRegistry) Register(event string, from int, f Upcaster) error {
+	if from < 1 {
+		return fmt.Errorf("upcaster version should gte 1: %d", from)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.upcasters[event]; !ok {
+		r.upcasters[event] = make(map[int]Upcaster)
+	}
+	r.upcasters[event][from] = f
+	if from+1 > r.versions[event] {
+		r.versions[event] = from + 1
+	}
+	return nil
+}
+
+// CurrentVersion 返回事件数据的当前版本
+func (r *UpcasterRegistry) CurrentVersion(event string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if v, ok := r.versions[event]; ok {
+		return v
+	}
+	return 1
+}
+
+// Upcast 把数据从 version 迁移到当前版本，返回迁移后的数据和版本
+func (r *UpcasterRegistry) Upcast(event string, version int, data interface{}) (interface{}, int, error) {
+	if version < 1 {
+		version = 1
+	}
+	current := r.CurrentVersion(event)
+	if version > current {
+		return nil, version, fmt.Errorf("event[%s] version %d newer than current version %d", event, version, current)
+	}
+	for ; version < current; version++ {
+		r.mu.RLock()
+		f, ok := r.upcasters[event][version]
+		r.mu.RUnlock()
+		if !ok {
+			return nil, version, fmt.Errorf("event[%s] upcaster from version %d not found", event, version)
+		}
+		v, err := f(data)
+		if err != nil {
+			return nil, version, err
+		}
+		data = v
+	}
+	return data, version, nil
+}
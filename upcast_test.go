@@ -0,0 +1,51 @@
+package maatq
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUpcasterRegistry(t *testing.T) {
+	r := NewUpcasterRegistry()
+	if v := r.CurrentVersion("user.created"); v != 1 {
+		t.Error("没有迁移函数的事件版本应该是1: ", v)
+	}
+
+	// v1: "name" => v2: {"name": name} => v3: 增加 "source"
+	r.Register("user.created", 1, func(data interface{}) (interface{}, error) {
+		return map[string]interface{}{"name": data}, nil
+	})
+	r.Register("user.created", 2, func(data interface{}) (interface{}, error) {
+		v := data.(map[string]interface{})
+		v["source"] = "legacy"
+		return v, nil
+	})
+	if v := r.CurrentVersion("user.created"); v != 3 {
+		t.Error("事件当前版本错误: ", v)
+	}
+
+	data, version, err := r.Upcast("user.created", 0, "yuez")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"name": "yuez", "source": "legacy"}
+	if version != 3 || !reflect.DeepEqual(data, expected) {
+		t.Error("迁移结果错误: ", version, data)
+	}
+
+	data, version, _ = r.Upcast("user.created", 3, expected)
+	if version != 3 || !reflect.DeepEqual(data, expected) {
+		t.Error("当前版本的数据不应该迁移: ", version, data)
+	}
+
+	if _, _, err := r.Upcast("user.created", 4, expected); err == nil {
+		t.Error("比当前版本新的数据应该返回错误")
+	}
+
+	r.Register("order.paid", 2, func(data interface{}) (interface{}, error) {
+		return data, nil
+	})
+	if _, _, err := r.Upcast("order.paid", 1, nil); err == nil {
+		t.Error("缺少迁移函数时应该返回错误")
+	}
+}
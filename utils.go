@@ -68,7 +68,9 @@ func inInt8Slice(n int8, data []int8) bool {
 	return i < len(data) && data[i] == n
 }
 
+const keyPrefix = "maatq:"
+
 // 生成完整的队列名称，例如 default => maatq:default
 func queueName(q string) string {
-	return "maatq:" + q
+	return keyPrefix + q
 }
@@ -3,11 +3,11 @@ package maatq
 import (
 	"encoding/json"
 	"errors"
+	"path"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/go-redis/redis"
 )
 
 var (
@@ -23,37 +23,73 @@ func (h EventHandler) Call(arg interface{}) (interface{}, error) {
 }
 
 // 消费者用于从队列中取消息，并且分配任务
-// 每个消费者包含一个 redis client 和 一个事件和函数的对应列表
+// 每个消费者包含一个存储后端和一个事件和函数的对应列表
 type Worker struct {
 	Id     int
 	Logger *log.Entry
 
-	client        *redis.Client
+	backend       Backend
 	eventHandlers map[string]EventHandler
 	try           int
 	c             chan int
 	mu            sync.Mutex
 	cm            *handlingMessage
 	queues        []string
+	patterns      []string
+	unhandled     UnhandledPolicy
+	delay         func(m *Message, d time.Duration)
+	startedAt     time.Time
+	stateMu       sync.RWMutex // 保护 current 和事件处理函数，心跳时读取
+	current       *handlingMessage
+	pauser        *queuePauser
+	payload       *payloadPipeline
+	verifier      *Verifier
+	schemas       *SchemaRegistry
+	upcasters     *UpcasterRegistry
+	failures      int // 连续接收失败的次数，用于退避
 }
 
+// AddEventHandler 注册事件处理函数，事件名称可以是通配模式，例如 user.*
 func (w *Worker) AddEventHandler(event string, handler EventHandler) error {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
 	if _, ok := w.eventHandlers[event]; ok {
 		return ErrEventAlreadyExists
 	}
+	if isEventPattern(event) {
+		if _, err := path.Match(event, ""); err != nil {
+			return err
+		}
+		w.patterns = append(w.patterns, event)
+		sortEventPatterns(w.patterns)
+	}
 	w.eventHandlers[event] = handler
 	return nil
 }
 
 func (w *Worker) RemoveEventHandler(event string) {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
 	delete(w.eventHandlers, event)
+	for i, p := range w.patterns {
+		if p == event {
+			w.patterns = append(w.patterns[:i], w.patterns[i+1:]...)
+			break
+		}
+	}
 }
 
-func (w *Worker) checkConn() {
-	cmd := w.client.Ping()
-	if err := cmd.Err(); err != nil {
-		w.Logger.Panic(err)
+// 查找事件的处理函数，精确匹配优先，其次是最具体的通配模式
+func (w *Worker) getEventHandler(event string) (EventHandler, bool) {
+	w.stateMu.RLock()
+	defer w.stateMu.RUnlock()
+	if h, ok := w.eventHandlers[event]; ok {
+		return h, true
 	}
+	if p, ok := matchEventPattern(w.patterns, event); ok {
+		return w.eventHandlers[p], true
+	}
+	return nil, false
 }
 
 func (w *Worker) initLog() {
@@ -67,42 +103,85 @@ func (w *Worker) Work() {
 	w.Logger.WithField("try", w.try).Info("Worker started")
 
 	for {
-		result, err := w.client.BLPop(0, w.queues...).Result()
-		if err != nil {
-			w.Logger.Error(err)
+		queues := w.pauser.active(w.queues)
+		if len(queues) == 0 {
+			time.Sleep(DefaultPollTimeout)
 			continue
 		}
 
-		w.Logger.WithFields(log.Fields{
-			"msg": result[1],
-		}).Debugf("[%s] message recieved", result[0])
-
-		cm, err := newHandlingMessage(result[0], result[1])
-		if err != nil {
-			w.Logger.Error(err)
-			continue
-		}
-		w.cm = cm
-
-		w.processCurrentMsg()
+		// 使用超时等待，以便及时响应队列的暂停
+		w.receive(DefaultPollTimeout, queues)
 	}
 
 	// 这个代码永远不会运行到
 	// w.c <- 1
 }
 
+// 等待并处理一条消息，没有收到消息时返回 false
+func (w *Worker) receive(timeout time.Duration, queues []string) bool {
+	var (
+		queue, ackId string
+		data         []byte
+		err          error
+	)
+	acker, ok := w.backend.(Acker)
+	if ok {
+		queue, data, ackId, err = acker.PopWithAck(timeout, queues...)
+	} else {
+		queue, data, err = w.backend.Pop(timeout, queues...)
+	}
+	if err == ErrNil {
+		w.failures = 0
+		return false
+	}
+	if err != nil {
+		// 连接错误时退避，避免空转
+		w.failures++
+		d := backoff(w.failures)
+		w.Logger.WithError(err).Errorf("Receive message error, retry in %s", d)
+		time.Sleep(d)
+		return false
+	}
+	w.failures = 0
+	if len(ackId) > 0 {
+		defer func() {
+			if err := acker.Ack(queue, ackId); err != nil {
+				w.Logger.WithError(err).Errorf("[%s] ack message %s error", queue, ackId)
+			}
+		}()
+	}
+
+	w.Logger.WithFields(log.Fields{
+		"msg": string(data),
+	}).Debugf("[%s] message recieved", queue)
+
+	cm, err := newHandlingMessage(queue, data)
+	if err != nil {
+		w.Logger.Error(err)
+		return true
+	}
+	cm.AckId = ackId
+	w.cm = cm
+
+	w.processCurrentMsg()
+	return true
+}
+
 // 处理当前消息
 func (w *Worker) processCurrentMsg() {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	w.setCurrent(w.cm)
 	w.handle()
 	w.cm = nil
+	w.setCurrent(nil)
 }
 
+// 把正在处理的消息放回队列，需要确认的消息不用放回，超时后会被重新认领
 func (w *Worker) pushBackCurrentMsg() {
-	if w.cm != nil {
-		bytes, _ := json.Marshal(w.cm.Msg)
-		w.client.LPush(w.cm.Queue, bytes)
+	if w.cm != nil && len(w.cm.AckId) == 0 {
+		bytes, _ := marshalMessage(w.cm.Msg)
+		w.backend.PushFront(w.cm.Queue, bytes)
 	}
 }
 
@@ -111,22 +190,32 @@ func (w *Worker) handle() {
 		hm      *handlingMessage = w.cm
 		message Message          = *(hm.Msg)
 		handler EventHandler
-		event   string
+		ok      bool
 	)
 
 	if !w.checkMessage(&message) {
 		return
 	}
 
-	event = message.Event
-	handler = w.eventHandlers[event]
-	result, err := handler.Call(message.Data)
+	if w.verifier != nil {
+		if err := w.verifier.Verify(&message); err != nil {
+			w.quarantine(&message, err)
+			return
+		}
+	}
+
+	handler, ok = w.getEventHandler(message.Event)
+	if !ok && w.unhandled.Action != UnhandledFallback {
+		w.handleUnhandled(&message)
+		return
+	}
+	result, err := w.call(handler, &message)
 
 	if err != nil {
 		w.cm.Error = err
 		w.cm.EndTime = time.Now()
 		w.Logger.WithFields(message.ToLogFields()).Errorf("[%.2fms] [%s]: %v", w.cm.milliSeconds(), "fail", err)
-		if message.Try < w.try {
+		if _, invalid := err.(*ValidationError); !invalid && message.Try < w.try {
 			w.requeue()
 		} else {
 			w.enqueueFailed()
@@ -137,41 +226,112 @@ func (w *Worker) handle() {
 		w.Logger.WithFields(message.ToLogFields()).Infof("[%.2fms] [%s]", w.cm.milliSeconds(), "ok")
 		w.Logger.WithFields(message.ToLogFields()).Debug("Result", result)
 		w.notify(true, "", result)
+		w.release(&message)
 	}
 }
 
-func (w *Worker) enqueueFailed() {
-	bytes, _ := json.Marshal(w.cm.Msg)
-	w.client.RPush(DefaultFailedQueue, string(bytes[:]))
+// 还原消息体并调用处理函数，handler 为空时调用兜底的处理函数
+// 还原后的消息只交给处理函数，避免解密后的数据被写入日志
+func (w *Worker) call(handler EventHandler, message *Message) (interface{}, error) {
+	decoded := *message
+	if err := w.payload.decode(&decoded); err != nil {
+		return nil, err
+	}
+	if w.upcasters != nil {
+		data, version, err := w.upcasters.Upcast(decoded.Event, decoded.Version, decoded.Data)
+		if err != nil {
+			return nil, err
+		}
+		decoded.Data, decoded.Version = data, version
+	}
+	if w.schemas != nil {
+		if err := w.schemas.Validate(decoded.Event, decoded.Data); err != nil {
+			return nil, err
+		}
+	}
+	if handler == nil {
+		return w.unhandled.Fallback.Call(&decoded)
+	}
+	return handler.Call(decoded.Data)
 }
 
-func (w *Worker) notify(success bool, errMsg string, data interface{}) {
-	var (
-		message *Message = w.cm.Msg
-		jResp   map[string]interface{}
-		resp    string
-	)
+// 把签名验证失败的消息移入隔离队列
+// 消息的内容不可信，数据引用可能指向其他消息的数据，不回收
+func (w *Worker) quarantine(message *Message, err error) {
+	q := tenantKey(message.Tenant, DefaultQuarantineQueue)
+	w.Logger.WithFields(message.ToLogFields()).WithError(err).Warnf("Message quarantined to %s", q)
+	bytes, _ := marshalMessage(w.cm.Msg)
+	w.backend.Push(q, bytes)
+}
 
-	jResp = map[string]interface{}{
-		"success":   success,
-		"error":     errMsg,
-		"data":      data,
-		"timestamp": time.Now().Unix(),
+// 移入失败队列，保留转存的数据，便于查看和重新执行
+func (w *Worker) enqueueFailed() {
+	bytes, _ := marshalMessage(w.cm.Msg)
+	w.backend.Push(tenantKey(w.cm.Msg.Tenant, DefaultFailedQueue), bytes)
+}
+
+// 回收处理完成的消息转存的数据，周期任务的数据是固定的，不会被回收
+func (w *Worker) release(message *Message) {
+	if err := w.payload.release(message); err != nil {
+		w.Logger.WithFields(message.ToLogFields()).WithError(err).Error("Release payload error")
 	}
+}
 
-	bytes, _ := json.Marshal(jResp)
-	resp = string(bytes[:])
-	w.Logger.WithField("eventId", message.Id).Debug(resp)
+func (w *Worker) notify(success bool, errMsg string, data interface{}) {
+	var message *Message = w.cm.Msg
 
-	w.client.Set(message.Id, resp, 0)
+	bytes, _ := json.Marshal(&Result{
+		Success:   success,
+		Error:     errMsg,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+	})
+	w.Logger.WithField("eventId", message.Id).Debug(string(bytes))
+
+	w.backend.Set(tenantKey(message.Tenant, message.Id), bytes, 0)
 }
 
 func (w *Worker) requeue() {
 	message := w.cm.Msg
 	message.Try += 1
 	message.Timestamp = time.Now().Unix()
-	bytes, _ := json.Marshal(message)
-	w.client.RPush(w.cm.Queue, string(bytes))
+	bytes, _ := marshalMessage(message)
+	w.backend.Push(w.cm.Queue, bytes)
+}
+
+// 按照 UnhandledPolicy 处理没有处理函数的消息
+func (w *Worker) handleUnhandled(message *Message) {
+	logger := w.Logger.WithFields(message.ToLogFields()).WithField("action", w.unhandled.Action.String())
+	switch w.unhandled.Action {
+	case UnhandledRequeue:
+		// 没有设置延迟的实现时不能保证消息不丢失，移入失败队列
+		if w.delay == nil {
+			logger.Warn("event handler for event not found, no scheduler to requeue, move to failed queue")
+			w.enqueueFailed()
+			return
+		}
+		if message.Try >= w.unhandled.maxAttempts() {
+			logger.Warnf("event handler for event not found after %d attempts, move to failed queue", message.Try)
+			w.enqueueFailed()
+			return
+		}
+		d := w.unhandled.requeueDelay()
+		logger.Warnf("event handler for event not found, requeue in %s", d)
+		m := *w.cm.Msg
+		m.Try++
+		w.delay(&m, d)
+	case UnhandledMove:
+		q := tenantKey(message.Tenant, w.unhandled.moveQueue())
+		logger.Warnf("event handler for event not found, move to %s", q)
+		bytes, _ := marshalMessage(w.cm.Msg)
+		w.backend.Push(q, bytes)
+	case UnhandledDeadLetter:
+		logger.Warn("event handler for event not found, move to failed queue")
+		w.enqueueFailed()
+	default:
+		logger.Error("event handler for event not found")
+		w.release(message)
+	}
 }
 
 func (w *Worker) checkMessage(message *Message) bool {
@@ -185,16 +345,6 @@ func (w *Worker) checkMessage(message *Message) bool {
 		err = "field event required"
 		w.Logger.WithFields(message.ToLogFields()).Error(err)
 		return checked
-	} else {
-		event := message.Event
-		_, ok := w.eventHandlers[event]
-
-		if !ok {
-			checked = false
-			err = "event handler for event not found"
-			w.Logger.WithFields(message.ToLogFields()).Error(err)
-			return checked
-		}
 	}
 
 	if len(message.Id) == 0 {
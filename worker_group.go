@@ -6,7 +6,6 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/go-redis/redis"
 )
 
 func init() {
@@ -17,29 +16,72 @@ func init() {
 
 var (
 	ErrParallel = errors.New("parallel should gte 0")
+
+	drainPollTimeout = 10 * time.Millisecond
 )
 
 type GroupOptions struct {
 	Parallel int
 	Addr     string
 	Password string
-	Try      int
-	Queues   []string
+	// Redis 连接配置，为空时使用 Addr 和 Password
+	Redis *RedisOptions
+	// 存储后端，为空时使用 Redis 连接配置
+	Backend Backend
+	Try     int
+	Queues  []string
+	// 所有键的命名空间
+	Namespace string
+	// 同时消费这些租户的队列
+	Tenants []string
+	// 没有事件处理函数时的处理策略
+	Unhandled UnhandledPolicy
+	// 注册表心跳间隔和过期时间
+	HeartbeatInterval time.Duration
+	WorkerTTL         time.Duration
+	// 保存大消息体的存储
+	BlobStore BlobStore
+	// 解密消息数据的密钥
+	Keyring *Keyring
+	// 验证消息签名
+	Verifier *Verifier
+	// 事件数据的版本迁移
+	Upcasters *UpcasterRegistry
+	// 启动时连接存储后端的重试次数，为0时使用 DefaultConnectRetries，小于0时不重试
+	ConnectRetries int
 }
 
 type WorkerGroup struct {
 	C       chan int
 	Workers []*Worker
 	options *GroupOptions
+	backend Backend
+	pauser  *queuePauser
+	payload *payloadPipeline
 }
 
 func (g *WorkerGroup) ServeLoop() {
 	for _, worker := range g.Workers {
 		go worker.Work()
 	}
+	go g.heartbeatLoop()
 	g.wait()
 }
 
+// 定时把所有 Worker 的状态写入注册表
+func (g *WorkerGroup) heartbeatLoop() {
+	ticker := time.NewTicker(g.options.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		for _, worker := range g.Workers {
+			if err := worker.register(g.options.WorkerTTL); err != nil {
+				worker.Logger.WithError(err).Error("Heartbeat error")
+			}
+		}
+		<-ticker.C
+	}
+}
+
 func (g *WorkerGroup) AddEventHandler(name string, handler EventHandler) {
 	log.Warningf("Event[%s] handled by Func[%s]", name, GetFunctionName(handler))
 	for _, worker := range g.Workers {
@@ -50,6 +92,53 @@ func (g *WorkerGroup) AddEventHandler(name string, handler EventHandler) {
 	}
 }
 
+// PauseQueue 暂停消费队列，local 为 true 时只对当前代理生效
+func (g *WorkerGroup) PauseQueue(queue string, local bool) error {
+	log.WithField("local", local).Warnf("Queue[%s] paused", queue)
+	return g.pauser.Pause(queueName(queue), local)
+}
+
+// ResumeQueue 恢复消费队列
+func (g *WorkerGroup) ResumeQueue(queue string, local bool) error {
+	log.WithField("local", local).Warnf("Queue[%s] resumed", queue)
+	return g.pauser.Resume(queueName(queue), local)
+}
+
+// PausedQueues 返回被暂停的队列
+func (g *WorkerGroup) PausedQueues() *PausedQueues {
+	return g.pauser.paused()
+}
+
+// Drain 使用第一个 Worker 同步处理队列中所有的消息，返回处理的消息数量
+func (g *WorkerGroup) Drain() int {
+	var (
+		n int
+		w = g.Workers[0]
+	)
+	for {
+		queues := w.pauser.active(w.queues)
+		if len(queues) == 0 || !w.receive(drainPollTimeout, queues) {
+			return n
+		}
+		n++
+	}
+}
+
+// SetSchemas 设置后 Worker 在调用处理函数前校验消息数据
+func (g *WorkerGroup) SetSchemas(r *SchemaRegistry) {
+	for _, worker := range g.Workers {
+		worker.schemas = r
+	}
+}
+
+// SetDelayFunc 设置未处理消息延迟重新入队的实现，例如使用调度器的 Delay
+// 没有设置时 UnhandledRequeue 的消息移入失败队列
+func (g *WorkerGroup) SetDelayFunc(f func(m *Message, d time.Duration)) {
+	for _, worker := range g.Workers {
+		worker.delay = f
+	}
+}
+
 func (g *WorkerGroup) wait() {
 	for i := 0; i < g.options.Parallel; i++ {
 		<-g.C
@@ -59,21 +148,26 @@ func (g *WorkerGroup) wait() {
 func (g *WorkerGroup) initWorkers() {
 	for i := 0; i < g.options.Parallel; i++ {
 		// 初始化Worker
-		c := &Worker{try: g.options.Try, c: g.C, Id: i}
+		c := &Worker{try: g.options.Try, c: g.C, Id: i, unhandled: g.options.Unhandled}
+		c.pauser = g.pauser
+		c.payload = g.payload
+		c.verifier = g.options.Verifier
+		c.upcasters = g.options.Upcasters
 		g.Workers[i] = c
 
 		for _, q := range g.options.Queues {
 			c.queues = append(c.queues, queueName(q))
 		}
+		for _, t := range g.options.Tenants {
+			for _, q := range g.options.Queues {
+				c.queues = append(c.queues, tenantQueueName(t, q))
+			}
+		}
 
-		c.client = redis.NewClient(&redis.Options{
-			Addr:     g.options.Addr,
-			Password: g.options.Password,
-			DB:       0,
-		})
+		c.backend = g.backend
 		c.eventHandlers = make(map[string]EventHandler)
+		c.startedAt = time.Now()
 		c.initLog()
-		c.checkConn()
 	}
 }
 
@@ -97,8 +191,9 @@ func (g *WorkerGroup) cleanup() {
 
 	for _, worker := range g.Workers {
 		worker.pushBackCurrentMsg()
-		worker.client.Close()
+		worker.unregister()
 	}
+	g.backend.Close()
 }
 
 // 获取监听队列的 Group
@@ -115,11 +210,40 @@ func NewWorkerGroup(opt *GroupOptions) (*WorkerGroup, error) {
 		return nil, errors.New("No queues for listening")
 	}
 
+	if err := opt.Unhandled.check(); err != nil {
+		return nil, err
+	}
+
+	if opt.HeartbeatInterval <= 0 {
+		opt.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+
+	if opt.WorkerTTL <= opt.HeartbeatInterval {
+		opt.WorkerTTL = 3 * opt.HeartbeatInterval
+	}
+
+	if opt.Redis == nil {
+		opt.Redis = &RedisOptions{Addrs: []string{opt.Addr}, Password: opt.Password}
+	}
+	// 不修改调用者的配置，同一个配置可以创建多个 WorkerGroup
+	backend := openBackend(opt.Backend, opt.Redis, opt.Namespace, nil)
+
+	if opt.ConnectRetries == 0 {
+		opt.ConnectRetries = DefaultConnectRetries
+	}
+	if err := connect(backend, opt.ConnectRetries); err != nil {
+		return nil, err
+	}
+
 	ptr := &WorkerGroup{
 		C:       make(chan int, opt.Parallel),
 		Workers: make([]*Worker, opt.Parallel),
 		options: opt,
+		backend: backend,
+		pauser:  newQueuePauser(backend, DefaultPollTimeout),
+		payload: newPayloadPipeline(opt.BlobStore, 0),
 	}
+	ptr.payload.setKeyring(opt.Keyring)
 
 	ptr.initWorkers()
 